@@ -0,0 +1,212 @@
+// Copyright 2022 DomesticMoth
+//
+// This file is part of Ytl.
+//
+// Ytl is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 3 of the License, or (at your option) any later version.
+//
+// Ytl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program; if not, write to the Free Software Foundation,
+// Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package ytl
+
+import (
+	"context"
+	"github.com/DomesticMoth/ytl/static"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Default interval of checking allow list file for changes
+const DEFAULT_ALLOW_LIST_WATCH_INTERVAL = time.Second * 5
+
+// AllowListFile is an AllowList loaded from file
+// that can be reloaded without restarting the process.
+//
+// File contains one hex encoded key per line,
+// text after '#' is a comment.
+// ( See static.ParseAllowList. )
+//
+// Reloaded list and its index are swapped atomically,
+// so readers always see either old or new list entirely.
+//
+// File must be updated atomically (written to temporary file
+// and renamed), otherwise half-written file may be loaded.
+// As a safeguard, non-empty list is never replaced with empty one,
+// unless file contains static.ALLOW_LIST_NONE line.
+//
+// It is safe for concurrent use.
+type AllowListFile struct {
+	path     string
+	list     atomic.Value
+	lockChan chan struct{}
+	modTime  time.Time
+	size     int64
+	hooks    []func(*static.AllowList)
+	logger   static.Logger
+}
+
+// Loads allow list from file.
+func NewAllowListFile(path string) (*AllowListFile, error) {
+	lock := make(chan struct{}, 1)
+	lock <- struct{}{}
+	a := &AllowListFile{
+		path,
+		atomic.Value{},
+		lock,
+		time.Time{},
+		0,
+		make([]func(*static.AllowList), 0),
+		static.NopLogger{},
+	}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AllowListFile) lock() {
+	<-a.lockChan
+}
+
+func (a *AllowListFile) unlock() {
+	a.lockChan <- struct{}{}
+}
+
+// Loaded list with its index
+type allowListSnapshot struct {
+	list  *static.AllowList
+	index *static.IndexedAllowList
+}
+
+// Sets logger for reload errors and changes.
+// Nil logger disables logging.
+func (a *AllowListFile) SetLogger(logger static.Logger) {
+	a.lock()
+	defer a.unlock()
+	a.logger = static.LoggerOrNop(logger)
+}
+
+// Returns path of file
+func (a *AllowListFile) Path() string {
+	return a.path
+}
+
+// Returns current allow list.
+// Returned list must not be modified.
+func (a *AllowListFile) AllowList() *static.AllowList {
+	return a.list.Load().(allowListSnapshot).list
+}
+
+// Returns index of current allow list
+// ( See static.IndexedAllowList. )
+func (a *AllowListFile) Index() *static.IndexedAllowList {
+	return a.list.Load().(allowListSnapshot).index
+}
+
+// Adds function that is called with new list after every successful reload.
+func (a *AllowListFile) OnChange(hook func(*static.AllowList)) {
+	a.lock()
+	defer a.unlock()
+	a.hooks = append(a.hooks, hook)
+}
+
+// Reads file and swaps current list with its content.
+//
+// If file can not be read or parsed,
+// or it is empty while current list is not
+// and static.ALLOW_LIST_NONE line is missing,
+// error is returned and current list is kept.
+func (a *AllowListFile) Reload() error {
+	a.lock()
+	file, err := os.Open(a.path)
+	if err != nil {
+		a.unlock()
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		a.unlock()
+		return err
+	}
+	// Broken file is not reread until it is changed again
+	a.modTime = info.ModTime()
+	a.size = info.Size()
+	list, none, err := static.ParseAllowListExplicit(file)
+	if err != nil {
+		a.unlock()
+		return err
+	}
+	// Empty file is likely truncated, denying everything by mistake
+	// would close all connections
+	if len(list) == 0 && !none && a.list.Load() != nil && len(*a.AllowList()) > 0 {
+		a.unlock()
+		return static.InvalidAllowListError{
+			Text: "list is empty, add \"" + static.ALLOW_LIST_NONE + "\" line to deny everything",
+		}
+	}
+	a.list.Store(allowListSnapshot{&list, static.NewIndexedAllowList(&list)})
+	hooks := make([]func(*static.AllowList), len(a.hooks))
+	copy(hooks, a.hooks)
+	logger := a.logger
+	a.unlock()
+	logger.Log(static.LOG_LEVEL_INFO, "Allow list loaded", "path", a.path, "keys", len(list))
+	for _, hook := range hooks {
+		hook(&list)
+	}
+	return nil
+}
+
+// Returns true if file modification time or size
+// differs from the loaded one.
+func (a *AllowListFile) changed() bool {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return false
+	}
+	a.lock()
+	defer a.unlock()
+	return !info.ModTime().Equal(a.modTime) || info.Size() != a.size
+}
+
+// Starts goroutine that checks file for changes
+// every interval and reloads it.
+// Errors are logged and current list is kept until file is fixed.
+//
+// If interval is not positive, DEFAULT_ALLOW_LIST_WATCH_INTERVAL is used.
+// Watching stops when ctx is done.
+func (a *AllowListFile) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DEFAULT_ALLOW_LIST_WATCH_INTERVAL
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if !a.changed() {
+				continue
+			}
+			if err := a.Reload(); err != nil {
+				a.lock()
+				logger := a.logger
+				a.unlock()
+				logger.Log(static.LOG_LEVEL_ERROR, "Allow list reload failed", "path", a.path, "err", err)
+			}
+		}
+	}()
+}
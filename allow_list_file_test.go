@@ -0,0 +1,217 @@
+// Copyright 2022 DomesticMoth
+//
+// This file is part of Ytl.
+//
+// Ytl is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 3 of the License, or (at your option) any later version.
+//
+// Ytl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program; if not, write to the Free Software Foundation,
+// Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package ytl
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"github.com/DomesticMoth/ytl/debugstuff"
+	"github.com/DomesticMoth/ytl/static"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeAllowListFile(t *testing.T, path string, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+}
+
+func TestParseAllowList(t *testing.T) {
+	pub1, _, _ := ed25519.GenerateKey(nil)
+	pub2, _, _ := ed25519.GenerateKey(nil)
+	text := "# comment\n\n" + hex.EncodeToString(pub1) + " # first\n  " + hex.EncodeToString(pub2) + "\n"
+	list, err := static.ParseAllowList(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(list) != 2 || !list.IsAllow(pub1) || !list.IsAllow(pub2) {
+		t.Errorf("Wrong list %v", list)
+	}
+	list, err = static.ParseAllowList(strings.NewReader("# empty\n"))
+	if err != nil || list == nil || len(list) != 0 {
+		t.Errorf("Empty file must give empty list: %v %s", list, err)
+	}
+	list, none, err := static.ParseAllowListExplicit(strings.NewReader("none # deny all\n"))
+	if err != nil || !none || len(list) != 0 {
+		t.Errorf("Explicitly empty list is not recognized: %v %v %s", list, none, err)
+	}
+	for _, text := range []string{"zz\n", "0102\n"} {
+		_, err := static.ParseAllowList(strings.NewReader("# bad\n" + text))
+		var e static.InvalidAllowListError
+		if !errors.As(err, &e) || e.Line != 2 || !errors.Is(err, static.ErrInvalidAllowList) {
+			t.Errorf("Wrong error for %q: %v", text, err)
+		}
+	}
+}
+
+func TestAllowListFileWatch(t *testing.T) {
+	pub1, _, _ := ed25519.GenerateKey(nil)
+	pub2, _, _ := ed25519.GenerateKey(nil)
+	path := filepath.Join(t.TempDir(), "allow")
+	writeAllowListFile(t, path, hex.EncodeToString(pub1)+"\n")
+	file, err := NewAllowListFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	changes := make(chan *static.AllowList, 1)
+	file.OnChange(func(list *static.AllowList) { changes <- list })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	file.Watch(ctx, time.Millisecond*10)
+	// Broken file must not replace current list
+	writeAllowListFile(t, path, "broken\n")
+	time.Sleep(time.Millisecond * 100)
+	if !file.AllowList().IsAllow(pub1) {
+		t.Errorf("Broken file replaced allow list")
+	}
+	writeAllowListFile(t, path, "# keys\n"+hex.EncodeToString(pub2)+"\n")
+	select {
+	case list := <-changes:
+		if list.IsAllow(pub1) || !list.IsAllow(pub2) {
+			t.Errorf("Wrong reloaded list")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("File was not reloaded")
+	}
+	if file.AllowList().IsAllow(pub1) || !file.AllowList().IsAllow(pub2) {
+		t.Errorf("Reloaded list is not visible")
+	}
+	if _, err := NewAllowListFile(filepath.Join(t.TempDir(), "missing")); !os.IsNotExist(err) {
+		t.Errorf("Wrong error for missing file: %v", err)
+	}
+}
+
+func TestAllowListFileEmpty(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(nil)
+	path := filepath.Join(t.TempDir(), "allow")
+	writeAllowListFile(t, path, hex.EncodeToString(pub)+"\n")
+	file, err := NewAllowListFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// Truncated file must not replace current list
+	writeAllowListFile(t, path, "")
+	if err := file.Reload(); !errors.Is(err, static.ErrInvalidAllowList) {
+		t.Errorf("Wrong error for empty file: %v", err)
+	}
+	if !file.AllowList().IsAllow(pub) {
+		t.Errorf("Empty file replaced allow list")
+	}
+	writeAllowListFile(t, path, static.ALLOW_LIST_NONE+"\n")
+	if err := file.Reload(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if list := file.AllowList(); list == nil || len(*list) != 0 {
+		t.Errorf("Explicitly empty file was not loaded: %v", list)
+	}
+	// There is no previous list on start, so empty file is loaded as is
+	writeAllowListFile(t, path, "")
+	if _, err := NewAllowListFile(path); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestConnManagerAllowListFile(t *testing.T) {
+	pub1, _, _ := ed25519.GenerateKey(nil)
+	pub2, _, _ := ed25519.GenerateKey(nil)
+	path := filepath.Join(t.TempDir(), "allow")
+	writeAllowListFile(t, path, hex.EncodeToString(pub1)+"\n")
+	file, err := NewAllowListFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	transports := []static.Transport{
+		debugstuff.MockTransport{Scheme: "a", SecureLvl: 0},
+	}
+	manager := NewConnManagerWithTransports(
+		context.Background(),
+		nil,
+		nil,
+		nil,
+		nil,
+		transports,
+	)
+	manager.SetAllowListFile(file, true)
+	uriFor := func(key ed25519.PublicKey) url.URL {
+		k := hex.EncodeToString(key)
+		uri, _ := url.Parse("a://host:123?mock_peer_key=" + k + "&mock_transport_key=" + k)
+		return *uri
+	}
+	conn1, err := manager.Connect(uriFor(pub1))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer conn1.Close()
+	if err := conn1.Handshake(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := manager.Connect(uriFor(pub2)); !errors.Is(err, static.ErrNotAllowed) {
+		t.Errorf("Key missing in file was allowed: %v", err)
+	}
+	// Connection allowed by "key" uri param does not depend on file
+	pinnedUri := uriFor(pub1)
+	pinnedUri.RawQuery += "&key=" + hex.EncodeToString(pub1)
+	pinned, err := manager.Connect(pinnedUri)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer pinned.Close()
+	if err := pinned.Handshake(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	listener, err := manager.Listen(uriFor(pub1))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	writeAllowListFile(t, path, hex.EncodeToString(pub2)+"\n")
+	if err := file.Reload(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	select {
+	case <-conn1.Done():
+	case <-time.After(time.Second * 5):
+		t.Errorf("Connection with removed key was not closed")
+	}
+	select {
+	case <-pinned.Done():
+		t.Errorf("Connection allowed by uri param was closed")
+	default:
+	}
+	conn2, err := manager.Connect(uriFor(pub2))
+	if err != nil {
+		t.Fatalf("Added key was not allowed: %s", err)
+	}
+	defer conn2.Close()
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer accepted.Close()
+	if err := accepted.Handshake(context.Background()); !errors.Is(err, static.ErrNotAllowed) {
+		t.Errorf("Listener does not see reloaded list: %v", err)
+	}
+}
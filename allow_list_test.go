@@ -0,0 +1,103 @@
+// Copyright 2022 DomesticMoth
+//
+// This file is part of Ytl.
+//
+// Ytl is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 3 of the License, or (at your option) any later version.
+//
+// Ytl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program; if not, write to the Free Software Foundation,
+// Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package ytl
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"github.com/DomesticMoth/ytl/static"
+	"testing"
+)
+
+func randomAllowList(size int) static.AllowList {
+	list := make(static.AllowList, size)
+	for i := range list {
+		list[i], _, _ = ed25519.GenerateKey(nil)
+	}
+	return list
+}
+
+func TestIndexedAllowList(t *testing.T) {
+	var nilList *static.IndexedAllowList = nil
+	if !nilList.IsAllow(nil) || nilList.Len() != 0 || nilList.Keys() != nil {
+		t.Errorf("Nil list must allow any key")
+	}
+	if static.NewIndexedAllowList(nil) != nil {
+		t.Errorf("Index of nil list must be nil")
+	}
+	list := randomAllowList(100)
+	list = append(list, ed25519.PublicKey{1, 2, 3})
+	index := static.NewIndexedAllowList(&list)
+	if index.Len() != 100 || len(index.Keys()) != 100 {
+		t.Errorf("Wrong index len %d", index.Len())
+	}
+	other := randomAllowList(100)
+	for _, key := range append(list[:100:100], other...) {
+		if list.IsAllow(key) != index.IsAllow(key) {
+			t.Errorf("Index differs from list for key %x", key)
+		}
+	}
+	changed := append(ed25519.PublicKey{}, list[0]...)
+	changed[31] ^= 1
+	for _, key := range []ed25519.PublicKey{nil, {1, 2, 3}, list[0][:31], changed} {
+		if index.IsAllow(key) {
+			t.Errorf("Key %x must not be allowed", key)
+		}
+	}
+	for _, key := range index.Keys() {
+		if !list.IsAllow(key) {
+			t.Errorf("Unknown key %x in index", key)
+		}
+	}
+	empty := make(static.AllowList, 0)
+	if static.NewIndexedAllowList(&empty).IsAllow(list[0]) {
+		t.Errorf("Empty list must deny any key")
+	}
+}
+
+func benchmarkAllowList(b *testing.B, indexed bool) {
+	for _, size := range []int{10, 1000, 50000} {
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			list := randomAllowList(size)
+			var filter static.KeyFilter = &list
+			if indexed {
+				filter = static.NewIndexedAllowList(&list)
+			}
+			// Last key is the worst case for slice
+			allowed := list[size-1]
+			denied := randomAllowList(1)[0]
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if i%2 == 0 {
+					filter.IsAllow(allowed)
+				} else {
+					filter.IsAllow(denied)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkAllowList(b *testing.B) {
+	benchmarkAllowList(b, false)
+}
+
+func BenchmarkIndexedAllowList(b *testing.B) {
+	benchmarkAllowList(b, true)
+}
@@ -80,7 +80,18 @@
 //			},
 //		)
 //
-// If you want to proxify connections to certain hosts via socks proxy,
+// If allowed keys change at runtime, load them from file
+// with one hex key per line. File is reloaded when it changes,
+// connections with removed keys are closed.
+//
+//		allowFile, err := ytl.NewAllowListFile("/etc/ytl/allow")
+//		if err != nil {
+//			panic(err)
+//		}
+//		allowFile.Watch(context.Background(), 0)
+//		manager.SetAllowListFile(allowFile, true)
+//
+// If you want to proxify connections to certain hosts via socks or http proxy,
 // you need to pass the ProxyManager object with the appropriate rules
 // to the ConnManager constructor.
 //
@@ -110,6 +121,48 @@
 //			nil,
 //		)
 //
+// Mapping can also name chain of proxies.
+// As example, connection to tor nodes may go through
+// corporate proxy first and then through tor.
+//
+//		corpProxy, _ := url.Parse("socks://corp-proxy:1080")
+//		mapping := ytl.ProxyMapping{
+//			HostRegexp: *regexp.MustCompile(`\.onion$`),
+//			Proxy:      corpProxy,
+//			Chain:      []*url.URL{torProxy},
+//		}
+//
+// Mappings can also match scheme, hostname suffix, port, ip network
+// and "key" uri param, bypass default proxy and have priorities.
+// Use ProxyManager.Explain to find out which mapping matched uri.
+//
+//		_, lan, _ := net.ParseCIDR("10.0.0.0/8")
+//		direct := ytl.ProxyMapping{
+//			Name:     "lan",
+//			Nets:     []*net.IPNet{lan},
+//			Direct:   true,
+//			Priority: 10,
+//		}
+//
+// ProxyManager can also be built from ALL_PROXY, HTTPS_PROXY
+// and NO_PROXY environment variables like in other network tools.
+//
+//		proxy, err := ytl.NewProxyManagerFromEnv([]ytl.ProxyMapping{direct})
+//
+// Mapping can list fallback proxies that are tried
+// if previous ones are unreachable. Failed proxies are skipped
+// with backoff, their state is available with ProxyManager.Health.
+//
+//		backupTor, _ := url.Parse("socks://localhost:9150")
+//		mapping.Fallback = []*url.URL{backupTor}
+//		proxy.StartHealthProbes(ctx, 0, nil)
+//
+// If you want ytl to send local handshake package by itself,
+// you need to pass protocol version to SetHandshakeVersion method.
+//
+//		version := static.PROTO_VERSION_0_5()
+//		manager.SetHandshakeVersion(&version)
+//
 // After you have created the ConnManager object,
 // you can use it to open outgoing connections with the Connect method
 // ( ConnectCtx and ConnectTimeout methods are also available ).
@@ -135,18 +188,106 @@
 //			}
 //		}
 //
+// Connections returned by YggListener.Accept may be closed later
+// if their handshake fails. To get only validated connections
+// use ValidatingListener. It also limits count of pending handshakes
+// and implements [net.Listener].
+//
+//		validated := ytl.NewValidatingListener(&listener, ytl.ValidatingListenerOptions{})
+//		defer validated.Close()
+//		conn, err := validated.Accept()
+//
+// If you want to keep connections to a set of peers alive,
+// you can use PeerSupervisor that reopens them with backoff.
+//
+//		supervisor := ytl.NewPeerSupervisor(manager, peers, func(uri url.URL, conn *ytl.YggConn) {
+//			// Pass conn to your code here
+//		})
+//		supervisor.Start()
+//		defer supervisor.Stop()
+//
+// If you want to track connection lifecycle (dials, accepts, handshakes,
+// rejects and closes), you can register ConnObserver.
+// Embed NopObserver to implement only needed methods.
+//
+//		type rejectLogger struct{ ytl.NopObserver }
+//
+//		func (rejectLogger) OnReject(event ytl.ConnEvent, reason error) {
+//			log.Printf("%s rejected: %s", event.Uri.String(), reason)
+//		}
+//
+//		manager.AddObserver(rejectLogger{})
+//
+// Dial, proxy negotiation and handshake timeouts
+// and tcp keepalive can be set with SetConfig method
+// or per connection with uri params.
+//
+//		manager.SetConfig(ytl.ConnManagerConfig{
+//			DialTimeout:      time.Second * 10,
+//			HandshakeTimeout: time.Second * 5,
+//		})
+//		addr, _ := url.Parse("tcp://host:1337?handshake_timeout=30s")
+//
+// ytl writes no logs by default.
+// To see what happens inside, pass logger with SetLogger method.
+// static.StdLogger adapts the standard library logger.
+//
+//		manager.SetLogger(static.StdLogger{Level: static.LOG_LEVEL_INFO})
+//
+// Connection and handshake metrics can be collected with Metrics
+// and scraped in prometheus text format over http.
+//
+//		http.Handle("/metrics", ytl.NewMetrics(manager))
+//
+// To stop the ConnManager gracefully use Shutdown method.
+// It closes all listeners and waits for open connections to be closed
+// until ctx is done ( Close method closes everything immediately ).
+//
+//		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+//		defer cancel()
+//		manager.Shutdown(ctx)
+//
 package ytl
 
 import (
 	"context"
 	"crypto/ed25519"
 	"encoding/hex"
+	"errors"
+	"github.com/DomesticMoth/ytl/dialers"
 	"github.com/DomesticMoth/ytl/static"
 	"github.com/DomesticMoth/ytl/transports"
+	"golang.org/x/crypto/blake2b"
+	"io"
+	"net"
 	"net/url"
 	"time"
 )
 
+// Name of uri param that overrides handshake timeout.
+// Value is parsed with time.ParseDuration.
+const HANDSHAKE_TIMEOUT_PARAM = "handshake_timeout"
+
+// Timeouts and keepalive options of ConnManager.
+// Zero values mean defaults.
+//
+// Every option may be overridden for single connection
+// by uri param, as example "tcp://host:1337?timeout=10s".
+type ConnManagerConfig struct {
+	// Timeout of establishing tcp connection
+	// ("timeout" uri param, dialers.DEFAULT_TIMEOUT by default)
+	DialTimeout time.Duration
+	// Extra time for negotiation with proxy
+	// ("proxy_timeout" uri param, dialers.DEFAULT_PROXY_TIMEOUT by default)
+	ProxyTimeout time.Duration
+	// Timeout of receiving handshake package
+	// ("handshake_timeout" uri param, DEFAULT_HANDSHAKE_TIMEOUT by default)
+	HandshakeTimeout time.Duration
+	// Tcp keepalive period, negative value disables keepalive
+	// ("keepalive" uri param, dialers.DEFAULT_KEEP_ALIVE by default)
+	KeepAlive time.Duration
+}
+
 // If key is not nil, retruns it as is.
 // If key is nil, generate new random key.
 func KeyFromOptionalKey(key ed25519.PrivateKey) ed25519.PrivateKey {
@@ -170,22 +311,98 @@ func transportsListToMap(list []static.Transport) map[string]static.Transport {
 	return transports_map
 }
 
+// Connects with transport trying chains of proxies
+// from ProxyManager in order.
+// Next chain is tried only if the first proxy of previous one is unreachable.
+// Results are reported to ProxyManager health state.
+func (c *ConnManager) connectWithFailover(
+	ctx context.Context,
+	transport static.Transport,
+	uri url.URL,
+	key ed25519.PrivateKey,
+) (conn static.ConnResult, err error) {
+	chains := c.proxyManager.GetChains(uri)
+	for i, chain := range chains {
+		conn, err = connectTransport(ctx, transport, uri, chain, key)
+		if len(chain) == 0 {
+			return
+		}
+		if err == nil {
+			c.proxyManager.Report(chain[0], nil)
+			return
+		}
+		if !errors.Is(err, static.ErrProxy) {
+			return
+		}
+		c.proxyManager.Report(chain[0], err)
+		if i+1 < len(chains) && ctx.Err() == nil {
+			c.logger.Log(
+				static.LOG_LEVEL_WARN, "Proxy failed, trying next one",
+				"uri", static.RedactUri(uri).String(), "proxy", chain[0].Redacted(), "err", err,
+			)
+			continue
+		}
+		return
+	}
+	return
+}
+
+// Connects with transport through chain of proxies.
+// Chains longer than one proxy require transport
+// to implement static.ProxyChainTransport.
+func connectTransport(
+	ctx context.Context,
+	transport static.Transport,
+	uri url.URL,
+	chain []*url.URL,
+	key ed25519.PrivateKey,
+) (static.ConnResult, error) {
+	switch len(chain) {
+	case 0:
+		return transport.Connect(ctx, uri, nil, key)
+	case 1:
+		return transport.Connect(ctx, uri, chain[0], key)
+	}
+	if t, ok := transport.(static.ProxyChainTransport); ok {
+		return t.ConnectChain(ctx, uri, chain, key)
+	}
+	return static.ConnResult{}, static.InapplicableProxyTypeError{
+		Transport: transport.GetScheme(),
+		Proxy:     *chain[1],
+	}
+}
+
 // Incapsulate list of transport realisations
 // and other lower level managers.
 // Manage opening & auto-closing connections,
 // keys, proxys & dedupliaction.
 type ConnManager struct {
-	transports   map[string]static.Transport
-	key          ed25519.PrivateKey
-	proxyManager ProxyManager
-	allowList    *static.AllowList
-	ctx          context.Context
-	dm           *DeduplicationManager
+	transports       map[string]static.Transport
+	key              ed25519.PrivateKey
+	proxyManager     ProxyManager
+	allowList        *allowListIndex
+	ctx              context.Context
+	dm               *DeduplicationManager
+	handshakeVersion *static.ProtoVersion
+	registry         *ConnRegistry
+	cancel           context.CancelFunc
+	listenersLock    chan struct{}
+	listeners        map[uint64]static.TransportListener
+	nextListenerId   uint64
+	observers        *observerList
+	logger           static.Logger
+	config           ConnManagerConfig
+	policy           *static.Policy
+	allowListFile    *AllowListFile
 }
 
 // Create new ConnManager with custom transports list.
 //
 // Key can be nill.
+//
+// AllowList is read through pointer on every check,
+// so its later changes are visible to ConnManager.
+// Keys in it must be replaced, not modified in place.
 func NewConnManagerWithTransports(
 	ctx context.Context,
 	key ed25519.PrivateKey,
@@ -199,7 +416,28 @@ func NewConnManagerWithTransports(
 		p := NewProxyManager(nil, nil)
 		proxy = &p
 	}
-	return &ConnManager{transports_map, key, *proxy, allowList, ctx, dm}
+	ctx, cancel := context.WithCancel(ctx)
+	listenersLock := make(chan struct{}, 1)
+	listenersLock <- struct{}{}
+	return &ConnManager{
+		transports_map,
+		key,
+		*proxy,
+		newAllowListIndex(allowList),
+		ctx,
+		dm,
+		nil,
+		NewConnRegistry(),
+		cancel,
+		listenersLock,
+		make(map[uint64]static.TransportListener),
+		0,
+		newObserverList(),
+		static.NopLogger{},
+		ConnManagerConfig{},
+		nil,
+		nil,
+	}
 }
 
 // Create new ConnManager with default transports list.
@@ -222,6 +460,63 @@ func NewConnManager(
 	)
 }
 
+// Enables sending of local handshake package
+// with passed protocol version by every connection
+// opened or accepted by ConnManager.
+// Handshake package is signed by ConnManager key.
+//
+// If version is nil (by default), ConnManager does not send
+// handshake package and caller must do it by itself.
+//
+// It must be called before opening connections.
+func (c *ConnManager) SetHandshakeVersion(version *static.ProtoVersion) error {
+	if version != nil {
+		if _, err := encodeMetaPackage(KeyFromOptionalKey(c.key), *version, 0, nil); err != nil {
+			return err
+		}
+	}
+	c.handshakeVersion = version
+	return nil
+}
+
+// Sets timeouts and keepalive options
+// used for connections opened or accepted by ConnManager.
+// Dial options are passed to transports
+// that implement static.ConfigurableTransport.
+//
+// It must be called before opening connections.
+func (c *ConnManager) SetConfig(config ConnManagerConfig) {
+	c.config = config
+	dialConfig := static.DialConfig{
+		Timeout:      config.DialTimeout,
+		ProxyTimeout: config.ProxyTimeout,
+		KeepAlive:    config.KeepAlive,
+	}
+	for scheme, transport := range c.transports {
+		if t, ok := transport.(static.ConfigurableTransport); ok {
+			c.transports[scheme] = t.WithConfig(dialConfig)
+		}
+	}
+}
+
+// Returns handshake timeout from "handshake_timeout" uri param or config
+func (c *ConnManager) handshakeTimeout(uri url.URL) (time.Duration, error) {
+	timeout, err := dialers.DurationFromUri(uri, HANDSHAKE_TIMEOUT_PARAM)
+	if err != nil || timeout != 0 {
+		return timeout, err
+	}
+	return c.config.HandshakeTimeout, nil
+}
+
+// Returns password from "password" uri param
+func passwordFromUri(uri url.URL) ([]byte, error) {
+	password := []byte(uri.Query().Get("password"))
+	if len(password) > blake2b.Size {
+		return nil, static.InvalidUriError{Err: "password is too long"}
+	}
+	return password, nil
+}
+
 // Selects the appropriate transport implementation
 // based on the uri scheme and opens the connection.
 //
@@ -235,15 +530,106 @@ func NewConnManager(
 // If ConnManager was constructed with non nil DeduplicationManager,
 // it will be used to close duplicate connections on early stage.
 //
+// If handshake version was set with SetHandshakeVersion,
+// local handshake package will be sent automatically.
+//
+// If uri contains "password" param, handshakes
+// with missing or wrong password will be rejected.
+//
 // It also accepts a context that allows you to
 // cancel the process ahead of time.
 func (c *ConnManager) ConnectCtx(ctx context.Context, uri url.URL) (*YggConn, error) {
-	var allowList *static.AllowList = nil
-	if c.allowList != nil {
-		allow := make(static.AllowList, len(*c.allowList))
-		copy(allow, *c.allowList)
-		allowList = &allow
+	password, err := passwordFromUri(uri)
+	if err != nil {
+		return nil, err
+	}
+	handshakeTimeout, err := c.handshakeTimeout(uri)
+	if err != nil {
+		return nil, err
 	}
+	allowList := c.outboundAllowList(uri)
+	if transport, ok := c.transports[uri.Scheme]; ok {
+		if err := c.policy.CheckIp(net.ParseIP(uri.Hostname())); err != nil {
+			c.observers.OnReject(ConnEvent{Uri: *static.RedactUri(uri), Direction: DIRECTION_OUTBOUND, Err: err}, err)
+			return nil, err
+		}
+		key := KeyFromOptionalKey(c.key)
+		started := time.Now()
+		conn, err := c.connectWithFailover(ctx, transport, uri, key)
+		event := ConnEvent{
+			Uri:       *static.RedactUri(uri),
+			Direction: DIRECTION_OUTBOUND,
+			Duration:  time.Since(started),
+			Err:       err,
+		}
+		if err == nil {
+			event.RemoteAddr = conn.Conn.RemoteAddr()
+			event.PublicKey = conn.Pkey
+			event.SecurityLevel = conn.SecurityLevel
+		}
+		if err != nil && !errors.Is(err, static.ErrDial) && isNetworkError(err) {
+			// Keep original transport error as cause
+			err = static.DialError{Addr: uri.Scheme + "://" + uri.Host, Err: err}
+			event.Err = err
+		}
+		c.observers.OnDial(event)
+		if err != nil {
+			c.logger.Log(static.LOG_LEVEL_DEBUG, "Dial failed", "uri", static.RedactUri(uri).String(), "err", err)
+			return nil, err
+		}
+		var rejectErr error = nil
+		if allowList != nil && (!allowList.IsAllow(conn.Pkey) || conn.Pkey == nil) {
+			rejectErr = static.IvalidPeerPublicKey{
+				Text: "Key received from the peer is not in the allow list",
+			}
+		} else if conn.Pkey != nil {
+			rejectErr = c.policy.CheckKey(conn.Pkey)
+		}
+		if rejectErr != nil {
+			conn.Conn.Close()
+			event.Err = rejectErr
+			c.logger.Log(
+				static.LOG_LEVEL_INFO, "Connection rejected",
+				"uri", static.RedactUri(uri).String(), "remote", event.RemoteAddr,
+				"key", conn.Pkey, "security", conn.SecurityLevel, "reason", rejectErr,
+			)
+			c.observers.OnReject(event, rejectErr)
+			return nil, rejectErr
+		}
+		if !c.registry.Reserve() {
+			conn.Conn.Close()
+			return nil, static.ManagerClosedError{}
+		}
+		defer c.registry.Release()
+		ygg, err := ConnToYggConnWithOptions(
+			conn.Conn, conn.Pkey, nil, conn.SecurityLevel, c.dm,
+			YggConnOptions{
+				Key:              key,
+				HandshakeVersion: c.handshakeVersion,
+				Password:         password,
+				Observer:         c.observers,
+				Uri:              uri,
+				Direction:        DIRECTION_OUTBOUND,
+				Logger:           c.logger,
+				HandshakeTimeout: handshakeTimeout,
+				Policy:           c.policy,
+				AllowKeys:        allowList,
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+		if !c.registry.Add(ygg, uri, DIRECTION_OUTBOUND) {
+			return nil, static.ManagerClosedError{}
+		}
+		return ygg, nil
+	}
+	return nil, static.UnknownSchemeError{Scheme: uri.Scheme}
+}
+
+// Returns allow list that outbound connection to uri is checked with.
+// Keys from "key" uri params replace allow list of ConnManager.
+func (c *ConnManager) outboundAllowList(uri url.URL) static.KeyFilter {
 	if pubkeys, ok := uri.Query()["key"]; ok && len(pubkeys) > 0 {
 		allow := make(static.AllowList, 0)
 		for _, pubkey := range pubkeys {
@@ -251,26 +637,23 @@ func (c *ConnManager) ConnectCtx(ctx context.Context, uri url.URL) (*YggConn, er
 				allow = append(allow, key)
 			}
 		}
-		allowList = &allow
+		return &allow
 	}
-	if transport, ok := c.transports[uri.Scheme]; ok {
-		conn, err := transport.Connect(
-			ctx,
-			uri,
-			c.proxyManager.Get(uri),
-			KeyFromOptionalKey(c.key),
-		)
-		if allowList != nil {
-			if !allowList.IsAllow(conn.Pkey) || conn.Pkey == nil {
-				conn.Conn.Close()
-				return nil, static.IvalidPeerPublicKey{
-					Text: "Key received from the peer is not in the allow list",
-				}
-			}
-		}
-		return ConnToYggConn(conn.Conn, conn.Pkey, allowList, conn.SecurityLevel, c.dm), err
+	return c.currentAllowList()
+}
+
+// Checks if transport error is caused by network.
+// Typed errors of static package are returned as is,
+// even if they implement net.Error.
+func isNetworkError(err error) bool {
+	if errorLabel(err) != "other" {
+		return false
 	}
-	return nil, static.UnknownSchemeError{Scheme: uri.Scheme}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed)
 }
 
 // Selects the appropriate transport implementation
@@ -341,16 +724,288 @@ func (c *ConnManager) ConnectTimeout(uri url.URL, timeout time.Duration) (*YggCo
 // Selects the appropriate transport implementation
 // based on the uri scheme and create listener object
 // that accpet incoming connections.
+//
+// If uri contains "password" param, incoming handshakes
+// with missing or wrong password will be rejected.
 func (c *ConnManager) Listen(uri url.URL) (ygg YggListener, err error) {
+	password, err := passwordFromUri(uri)
+	if err != nil {
+		return
+	}
+	handshakeTimeout, err := c.handshakeTimeout(uri)
+	if err != nil {
+		return
+	}
 	if transport, ok := c.transports[uri.Scheme]; ok {
-		listener, e := transport.Listen(c.ctx, uri, KeyFromOptionalKey(c.key))
+		key := KeyFromOptionalKey(c.key)
+		listener, e := transport.Listen(c.ctx, uri, key)
 		err = e
 		if err != nil {
 			return
 		}
-		ygg = YggListener{listener, c.dm, c.allowList}
+		onClose, ok := c.addListener(listener)
+		if !ok {
+			listener.Close()
+			err = static.ManagerClosedError{}
+			return
+		}
+		c.logger.Log(static.LOG_LEVEL_INFO, "Listening", "uri", static.RedactUri(uri).String())
+		ygg = YggListener{
+			listener,
+			c.observers,
+			c.logger,
+			c.dm,
+			c.currentAllowList,
+			key,
+			c.handshakeVersion,
+			password,
+			uri,
+			c.registry,
+			onClose,
+			handshakeTimeout,
+			c.policy,
+		}
 		return
 	}
 	err = static.UnknownSchemeError{Scheme: uri.Scheme}
 	return
 }
+
+// Returns info about all live connections
+// opened or accepted by ConnManager.
+func (c *ConnManager) Connections() []ConnInfo {
+	return c.registry.Connections()
+}
+
+// Returns info about live connections with node by its key.
+func (c *ConnManager) ConnectionsByKey(key ed25519.PublicKey) []ConnInfo {
+	return c.registry.ConnectionsByKey(key)
+}
+
+// Sets logger for ConnManager internals.
+// Logger is also passed to DeduplicationManager
+// and to transports that implement static.LoggingTransport.
+// Nil logger disables logging.
+//
+// It must be called before opening connections.
+func (c *ConnManager) SetLogger(logger static.Logger) {
+	c.logger = static.LoggerOrNop(logger)
+	if c.dm != nil {
+		c.dm.SetLogger(c.logger)
+	}
+	for scheme, transport := range c.transports {
+		if t, ok := transport.(static.LoggingTransport); ok {
+			c.transports[scheme] = t.WithLogger(c.logger)
+		}
+	}
+}
+
+// Sets policy with key and address filters.
+// Policy is checked in addition to AllowList:
+//   - by ConnectCtx before dialing (for literal ip addresses)
+//     and by transports that implement static.PolicyTransport
+//     after destination address is resolved
+//   - by YggListener at accept time before reading handshake
+//   - by YggConn when peer key is received
+//
+// Nil policy allows everything.
+// It must be called before opening connections.
+func (c *ConnManager) SetPolicy(policy *static.Policy) {
+	c.policy = policy
+	for scheme, transport := range c.transports {
+		if t, ok := transport.(static.PolicyTransport); ok {
+			c.transports[scheme] = t.WithPolicy(policy)
+		}
+	}
+}
+
+// Sets reloadable allow list that replaces AllowList
+// passed to constructor.
+// Every reload of file is visible to next ConnectCtx call
+// and to next connection accepted by YggListener.
+//
+// If closeRemoved is true, live connections with nodes
+// which keys were removed from file are closed after reload.
+//
+// Call file.Watch to reload it automatically.
+// It must be called before opening connections.
+func (c *ConnManager) SetAllowListFile(file *AllowListFile, closeRemoved bool) {
+	c.allowListFile = file
+	if file != nil && closeRemoved {
+		file.OnChange(func(*static.AllowList) { c.closeNotAllowed() })
+	}
+}
+
+// Index of AllowList passed to ConnManager constructor.
+// List may be changed by caller after construction,
+// so index is rebuilt when list differs from indexed one.
+type allowListIndex struct {
+	list     *static.AllowList
+	lockChan chan struct{}
+	// Shallow copy of indexed list
+	keys  static.AllowList
+	index *static.IndexedAllowList
+}
+
+func newAllowListIndex(list *static.AllowList) *allowListIndex {
+	lock := make(chan struct{}, 1)
+	lock <- struct{}{}
+	return &allowListIndex{list, lock, nil, nil}
+}
+
+// Returns true if lists contain the same key slices.
+// Only slice headers are compared, so it does not depend on key bytes.
+func sameKeys(a, b static.AllowList) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if len(a[i]) != len(b[i]) || (len(a[i]) > 0 && &a[i][0] != &b[i][0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns index of current content of list (nil if list is nil)
+func (a *allowListIndex) Get() *static.IndexedAllowList {
+	if a.list == nil {
+		return nil
+	}
+	<-a.lockChan
+	defer func() { a.lockChan <- struct{}{} }()
+	if a.index == nil || !sameKeys(a.keys, *a.list) {
+		a.keys = append(make(static.AllowList, 0, len(*a.list)), *a.list...)
+		a.index = static.NewIndexedAllowList(&a.keys)
+	}
+	return a.index
+}
+
+// Returns indexed allow list from file if it is set
+// or AllowList passed to constructor.
+// Returns nil interface if any key is allowed.
+func (c *ConnManager) currentAllowList() static.KeyFilter {
+	var list *static.IndexedAllowList = nil
+	if c.allowListFile != nil {
+		list = c.allowListFile.Index()
+	} else {
+		list = c.allowList.Get()
+	}
+	if list == nil {
+		return nil
+	}
+	return list
+}
+
+// Closes live connections with nodes which keys are not allowed.
+func (c *ConnManager) closeNotAllowed() {
+	list := c.currentAllowList()
+	if list == nil {
+		return
+	}
+	for _, info := range c.registry.Connections() {
+		filter := list
+		if info.Direction == DIRECTION_OUTBOUND {
+			// Checked with the same rule as in ConnectCtx,
+			// so connections with "key" uri param are kept
+			filter = c.outboundAllowList(info.Uri)
+		}
+		if info.PublicKey == nil || filter.IsAllow(info.PublicKey) {
+			continue
+		}
+		c.logger.Log(
+			static.LOG_LEVEL_INFO, "Closing connection removed from allow list",
+			"uri", static.RedactUri(info.Uri).String(), "remote", info.RemoteAddr, "key", info.PublicKey,
+		)
+		info.Conn.Close()
+	}
+}
+
+// Registers observer that will receive lifecycle events
+// of all connections opened or accepted after this call.
+func (c *ConnManager) AddObserver(observer ConnObserver) {
+	c.observers.Add(observer)
+}
+
+// Registers listener to close it on shutdown.
+// Returns callback that listener must call on close
+// or false if ConnManager is already closed.
+func (c *ConnManager) addListener(listener static.TransportListener) (func(), bool) {
+	<-c.listenersLock
+	defer func() { c.listenersLock <- struct{}{} }()
+	if c.ctx.Err() != nil {
+		return nil, false
+	}
+	id := c.nextListenerId
+	c.nextListenerId += 1
+	c.listeners[id] = listener
+	return func() {
+		<-c.listenersLock
+		defer func() { c.listenersLock <- struct{}{} }()
+		delete(c.listeners, id)
+	}, true
+}
+
+// Closes all listeners created by ConnManager.
+// Closes all listeners and returns the first error.
+func (c *ConnManager) closeListeners() (err error) {
+	<-c.listenersLock
+	listeners := c.listeners
+	c.listeners = make(map[uint64]static.TransportListener)
+	c.listenersLock <- struct{}{}
+	for _, listener := range listeners {
+		if e := listener.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+// Shutdown gracefully stops ConnManager.
+//
+// It cancels ConnManager context, so new connections
+// can not be opened or accepted anymore,
+// closes all listeners and waits for in-progress handshakes.
+// Then it waits for established connections to be closed by their users.
+//
+// If ctx is done before all connections are closed,
+// remaining connections are closed forcibly and ctx error is returned.
+// Shutdown returns only after all handshake goroutines
+// of all wrapped connections are finished.
+func (c *ConnManager) Shutdown(ctx context.Context) error {
+	c.cancel()
+	c.registry.Close()
+	listenersErr := c.closeListeners()
+	err := c.registry.Wait(ctx)
+	if err != nil {
+		c.closeConnections()
+		c.registry.Wait(context.Background())
+		return err
+	}
+	return listenersErr
+}
+
+// Closes all registered connections and returns the first error.
+func (c *ConnManager) closeConnections() (err error) {
+	for _, info := range c.registry.Connections() {
+		if e := info.Conn.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+// Close immediately closes all listeners and connections
+// of ConnManager and waits for handshake goroutines to finish.
+//
+// Returns the first error of closing listeners or connections.
+func (c *ConnManager) Close() error {
+	c.cancel()
+	c.registry.Close()
+	err := c.closeListeners()
+	if e := c.closeConnections(); e != nil && err == nil {
+		err = e
+	}
+	c.registry.Wait(context.Background())
+	return err
+}
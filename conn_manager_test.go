@@ -23,12 +23,16 @@ import (
 	"context"
 	"crypto/ed25519"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/DomesticMoth/ytl/debugstuff"
 	"github.com/DomesticMoth/ytl/static"
 	"net"
 	"net/url"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestKeyFromOptionalKey(t *testing.T) {
@@ -214,6 +218,47 @@ func TestConnManagerAllowList(t *testing.T) {
 	}
 }
 
+// Testing that changes of AllowList after construction are visible
+func TestConnManagerAllowListChanged(t *testing.T) {
+	transports := []static.Transport{
+		debugstuff.MockTransport{Scheme: "a", SecureLvl: 0},
+	}
+	allow1 := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	allow2 := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	allow1[0] = 1
+	allow2[0] = 2
+	allowList := static.AllowList{allow1}
+	manager := NewConnManagerWithTransports(
+		context.Background(),
+		nil,
+		nil,
+		nil,
+		&allowList,
+		transports,
+	)
+	connect := func(key ed25519.PublicKey) error {
+		uri, _ := url.Parse(
+			fmt.Sprintf("a://host:123?mock_transport_key=%s", hex.EncodeToString(key)),
+		)
+		conn, err := manager.Connect(*uri)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	if err := connect(allow2); err == nil {
+		t.Errorf("Key that is not in the AllowList was allowed")
+	}
+	allowList = append(allowList, allow2)
+	if err := connect(allow2); err != nil {
+		t.Errorf("Appended key was not allowed: %s", err)
+	}
+	allowList[1] = publicKeyFromOptionalKey(nil)
+	if err := connect(allow2); err == nil {
+		t.Errorf("Replaced key is still allowed")
+	}
+}
+
 // Testing that uri "key" key ignoring AllowList
 func TestConnManagerIgnoreAllowList(t *testing.T) {
 	pkey := make(ed25519.PrivateKey, ed25519.PrivateKeySize)
@@ -251,3 +296,321 @@ func TestConnManagerIgnoreAllowList(t *testing.T) {
 		}
 	}
 }
+
+func TestConnManagerPassword(t *testing.T) {
+	transports := []static.Transport{
+		debugstuff.MockTransport{Scheme: "a", SecureLvl: 0},
+	}
+	manager := NewConnManagerWithTransports(
+		context.Background(),
+		nil,
+		nil,
+		nil,
+		nil,
+		transports,
+	)
+	uri, _ := url.Parse("a://host:123?password=" + strings.Repeat("p", 65))
+	if _, err := manager.Connect(*uri); err == nil {
+		t.Errorf("Too long password should cause an error")
+	}
+	// Mock transport sends v0.4 handshake that can not carry password
+	uri, _ = url.Parse("a://host:123?password=password")
+	conn, err := manager.Connect(*uri)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer conn.Close()
+	_, err = conn.Read(make([]byte, 1))
+	switch err.(type) {
+	case static.InvalidPasswordError:
+		// Ok
+	default:
+		t.Errorf("Connection was not closed by password check: %s", err)
+	}
+}
+
+func TestConnManagerShutdown(t *testing.T) {
+	transports := []static.Transport{
+		debugstuff.MockTransport{Scheme: "a", SecureLvl: 0},
+	}
+	manager := NewConnManagerWithTransports(
+		context.Background(),
+		nil,
+		nil,
+		nil,
+		nil,
+		transports,
+	)
+	uri, _ := url.Parse("a://host:123")
+	conn, err := manager.Connect(*uri)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	listener, err := manager.Listen(*uri)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// Connection is closed by user, so shutdown completes without error
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		conn.Close()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := manager.Shutdown(ctx); err != nil {
+		t.Errorf("Unexpected shutdown error: %s", err)
+	}
+	if len(manager.Connections()) != 0 {
+		t.Errorf("Connections are still registered")
+	}
+	if _, err := listener.Accept(); err == nil {
+		t.Errorf("Listener was not closed")
+	}
+	if _, err := manager.Connect(*uri); err == nil {
+		t.Errorf("Closed manager should not open new connections")
+	}
+	if _, err := manager.Listen(*uri); err == nil {
+		t.Errorf("Closed manager should not open new listeners")
+	}
+}
+
+func TestConnManagerShutdownTimeout(t *testing.T) {
+	transports := []static.Transport{
+		debugstuff.MockTransport{Scheme: "a", SecureLvl: 0},
+	}
+	manager := NewConnManagerWithTransports(
+		context.Background(),
+		nil,
+		nil,
+		nil,
+		nil,
+		transports,
+	)
+	uri, _ := url.Parse("a://host:123")
+	conn, err := manager.Connect(*uri)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := manager.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Wrong shutdown error: %s", err)
+	}
+	select {
+	case <-conn.Done():
+	default:
+		t.Errorf("Connection was not closed forcibly")
+	}
+	if len(manager.Connections()) != 0 {
+		t.Errorf("Connections are still registered")
+	}
+	if err := manager.Close(); err != nil {
+		t.Errorf("Unexpected close error: %s", err)
+	}
+}
+
+// Mock transport that records dial config it was connected with
+type configTransport struct {
+	debugstuff.MockTransport
+	config  static.DialConfig
+	configs chan static.DialConfig
+}
+
+func (t configTransport) WithConfig(config static.DialConfig) static.Transport {
+	t.config = config
+	return t
+}
+
+func (t configTransport) Connect(ctx context.Context, uri url.URL, proxy *url.URL, key ed25519.PrivateKey) (static.ConnResult, error) {
+	t.configs <- t.config
+	return t.MockTransport.Connect(ctx, uri, proxy, key)
+}
+
+func TestConnManagerConfig(t *testing.T) {
+	configs := make(chan static.DialConfig, 3)
+	transports := []static.Transport{
+		configTransport{
+			MockTransport: debugstuff.MockTransport{Scheme: "a", SecureLvl: 0},
+			configs:       configs,
+		},
+	}
+	manager := NewConnManagerWithTransports(
+		context.Background(),
+		nil,
+		nil,
+		nil,
+		nil,
+		transports,
+	)
+	manager.SetConfig(ConnManagerConfig{
+		DialTimeout:      time.Second * 10,
+		HandshakeTimeout: time.Millisecond * 50,
+	})
+	uri, _ := url.Parse("a://host:123?keepalive=1m&mock_delay_before_meta=1s")
+	conn, err := manager.Connect(*uri)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_, err = conn.Read(make([]byte, 1))
+	switch err.(type) {
+	case static.ConnTimeoutError:
+		// Ok
+	default:
+		t.Errorf("Handshake timeout from config was not applied: %s", err)
+	}
+	conn.Close()
+	// Uri params override config
+	uri, _ = url.Parse("a://host:123?handshake_timeout=5s&mock_delay_before_meta=100ms")
+	conn, err = manager.Connect(*uri)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	info := debugstuff.ReadMockTransportInfoAfterHeader(conn)
+	if !strings.Contains(info, "'uri':'"+uri.String()+"'") {
+		t.Errorf("Config must not be added to uri: %s", info)
+	}
+	<-configs
+	if config := <-configs; config != (static.DialConfig{Timeout: time.Second * 10}) {
+		t.Errorf("Dial config was not passed to transport: %v", config)
+	}
+	uri, _ = url.Parse("a://host:123?handshake_timeout=abc")
+	if _, err := manager.Connect(*uri); err == nil {
+		t.Errorf("Invalid handshake timeout should cause an error")
+	}
+}
+
+func TestConnManagerWrappedErrors(t *testing.T) {
+	manager := NewConnManager(context.Background(), nil, nil, nil, nil)
+	// Nothing listens on this port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	uri, _ := url.Parse("tcp://" + addr)
+	_, err = manager.Connect(*uri)
+	if !errors.Is(err, static.ErrDial) {
+		t.Fatalf("Dial error is not wrapped: %s", err)
+	}
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		t.Errorf("Network cause is lost: %s", err)
+	}
+	if reason := static.ReasonOf(err); reason != static.REJECT_REASON_NETWORK {
+		t.Errorf("Wrong reject reason %s", reason)
+	}
+	// Typed errors are not wrapped as dial errors
+	uri, _ = url.Parse("tcp://" + addr + "?timeout=abc")
+	_, err = manager.Connect(*uri)
+	if _, ok := err.(static.InvalidUriError); !ok {
+		t.Errorf("Typed error is wrapped: %s", err)
+	}
+	transports := []static.Transport{
+		debugstuff.MockTransport{Scheme: "a", SecureLvl: 0},
+	}
+	allowList := static.AllowList{debugstuff.MockPubKey()}
+	manager = NewConnManagerWithTransports(
+		context.Background(),
+		nil,
+		nil,
+		nil,
+		&allowList,
+		transports,
+	)
+	uri, _ = url.Parse("a://host:123?mock_transport_key=" + hex.EncodeToString(make([]byte, 32)))
+	_, err = manager.Connect(*uri)
+	if !errors.Is(err, static.ErrNotAllowed) {
+		t.Errorf("Wrong error %s", err)
+	}
+	if reason := static.ReasonOf(err); reason != static.REJECT_REASON_NOT_ALLOWED {
+		t.Errorf("Wrong reject reason %s", reason)
+	}
+	// Rejected connection keeps reason in state
+	// but Close returns real error
+	uri, _ = url.Parse(
+		"a://host:123?mock_transport_key=" + hex.EncodeToString(debugstuff.MockPubKey()) +
+			"&mock_peer_key=" + hex.EncodeToString(make([]byte, 32)),
+	)
+	conn, err := manager.Connect(*uri)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := conn.Handshake(context.Background()); !errors.Is(err, static.ErrTransportKeyMismatch) {
+		t.Errorf("Wrong handshake error %s", err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Errorf("Close error is masked: %s", err)
+	}
+	if state := conn.ConnectionState(); static.ReasonOf(state.Err) != static.REJECT_REASON_TRANSPORT_KEY {
+		t.Errorf("Wrong terminal error %s", state.Err)
+	}
+}
+
+func TestConnManagerPolicy(t *testing.T) {
+	transports := []static.Transport{
+		debugstuff.MockTransport{Scheme: "a", SecureLvl: 0},
+	}
+	manager := NewConnManagerWithTransports(
+		context.Background(),
+		nil,
+		nil,
+		nil,
+		nil,
+		transports,
+	)
+	nets, _ := static.ParseCIDRs("10.0.0.0/8")
+	manager.SetPolicy(&static.Policy{
+		DenyKeys: []ed25519.PublicKey{debugstuff.MockPubKey()},
+		DenyNets: nets,
+	})
+	uri, _ := url.Parse("a://10.1.2.3:123")
+	if _, err := manager.Connect(*uri); !errors.Is(err, static.ErrUnacceptableAddress) {
+		t.Errorf("Denied address was dialed: %s", err)
+	}
+	uri, _ = url.Parse("a://host:123?mock_peer_key=" + hex.EncodeToString(debugstuff.MockPubKey()))
+	conn, err := manager.Connect(*uri)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer conn.Close()
+	if err := conn.Handshake(context.Background()); !errors.Is(err, static.ErrNotAllowed) {
+		t.Errorf("Denied key was not rejected: %s", err)
+	}
+	uri, _ = url.Parse("a://host:123")
+	conn, err = manager.Connect(*uri)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer conn.Close()
+	if err := conn.Handshake(context.Background()); err != nil {
+		t.Errorf("Allowed key was rejected: %s", err)
+	}
+}
+
+func TestConnManagerProxyChainUnsupported(t *testing.T) {
+	transports := []static.Transport{
+		debugstuff.MockTransport{Scheme: "a", SecureLvl: 0},
+	}
+	first, _ := url.Parse("socks://first")
+	second, _ := url.Parse("socks://second")
+	proxy := NewProxyManager(nil, []ProxyMapping{
+		{
+			HostRegexp: *regexp.MustCompile(`.*`),
+			Proxy:      first,
+			Chain:      []*url.URL{second},
+		},
+	})
+	manager := NewConnManagerWithTransports(
+		context.Background(),
+		nil,
+		&proxy,
+		nil,
+		nil,
+		transports,
+	)
+	uri, _ := url.Parse("a://host:123")
+	if _, err := manager.Connect(*uri); !errors.Is(err, static.ErrInapplicableProxy) {
+		t.Errorf("Chain was used with transport that does not support it: %v", err)
+	}
+}
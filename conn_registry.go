@@ -0,0 +1,253 @@
+// Copyright 2022 DomesticMoth
+//
+// This file is part of Ytl.
+//
+// Ytl is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 3 of the License, or (at your option) any later version.
+//
+// Ytl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program; if not, write to the Free Software Foundation,
+// Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package ytl
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"github.com/DomesticMoth/ytl/static"
+	"net"
+	"net/url"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Direction of connection
+type ConnDirection uint8
+
+const (
+	// Connection opened by ConnManager.Connect
+	DIRECTION_OUTBOUND ConnDirection = 0
+	// Connection accepted by YggListener
+	DIRECTION_INBOUND ConnDirection = 1
+)
+
+func (d ConnDirection) String() string {
+	if d == DIRECTION_INBOUND {
+		return "inbound"
+	}
+	return "outbound"
+}
+
+// ConnInfo is a snapshot of live connection state.
+type ConnInfo struct {
+	// The connection itself
+	Conn *YggConn
+	// Connected uri for outbound connections
+	// or listened uri for inbound ones
+	Uri        url.URL
+	RemoteAddr net.Addr
+	// Key of connected node (nil until handshake package is received)
+	PublicKey ed25519.PublicKey
+	// Protocol version (nil until handshake package is received)
+	Version       *static.ProtoVersion
+	SecurityLevel uint
+	Direction     ConnDirection
+	Started       time.Time
+	BytesRead     uint64
+	BytesWritten  uint64
+}
+
+type registryEntry struct {
+	conn      *YggConn
+	uri       url.URL
+	direction ConnDirection
+	started   time.Time
+}
+
+func (e *registryEntry) info() ConnInfo {
+	key, version := e.conn.peerInfo()
+	return ConnInfo{
+		Conn:          e.conn,
+		Uri:           e.uri,
+		RemoteAddr:    e.conn.RemoteAddr(),
+		PublicKey:     key,
+		Version:       version,
+		SecurityLevel: e.conn.secureTranport,
+		Direction:     e.direction,
+		Started:       e.started,
+		BytesRead:     atomic.LoadUint64(&e.conn.bytesRead),
+		BytesWritten:  atomic.LoadUint64(&e.conn.bytesWritten),
+	}
+}
+
+// Stores all live connections of ConnManager.
+// Connections are removed from it on close.
+//
+// It also counts connections which handshake goroutines
+// are not finished yet, so closed registry can wait for them.
+//
+// It is safe for concurrent use.
+type ConnRegistry struct {
+	lockChan chan struct{}
+	entries  map[uint64]*registryEntry
+	nextId   uint64
+	closed   bool
+	// Count of added connections that are not closed
+	// or which handshake goroutines are not finished
+	live int
+	// Count of reservations made by Reserve
+	pending int
+	// Closed when registry is closed and both counters are zero
+	drained chan struct{}
+}
+
+func NewConnRegistry() *ConnRegistry {
+	lock := make(chan struct{}, 1)
+	lock <- struct{}{}
+	return &ConnRegistry{lock, make(map[uint64]*registryEntry), 0, false, 0, 0, make(chan struct{})}
+}
+
+func (r *ConnRegistry) lock() {
+	<-r.lockChan
+}
+
+func (r *ConnRegistry) unlock() {
+	r.lockChan <- struct{}{}
+}
+
+// Closes drained channel if registry is closed and empty.
+// Lock must be held.
+func (r *ConnRegistry) checkDrained() {
+	if r.closed && r.live == 0 && r.pending == 0 {
+		select {
+		case <-r.drained:
+		default:
+			close(r.drained)
+		}
+	}
+}
+
+// Reserves place for connection that is going to be wrapped to YggConn
+// and added, so Wait does not return before it is added.
+// Every successful call must be followed by Release.
+//
+// Returns false if registry is closed.
+func (r *ConnRegistry) Reserve() bool {
+	r.lock()
+	defer r.unlock()
+	if r.closed {
+		return false
+	}
+	r.pending += 1
+	return true
+}
+
+// Releases reservation made by Reserve.
+func (r *ConnRegistry) Release() {
+	r.lock()
+	defer r.unlock()
+	r.pending -= 1
+	r.checkDrained()
+}
+
+// Adds connection to registry until it is closed.
+//
+// If registry is closed, connection is closed immediately
+// and false is returned.
+// In both cases Wait waits for connection handshake goroutine.
+func (r *ConnRegistry) Add(conn *YggConn, uri url.URL, direction ConnDirection) bool {
+	r.lock()
+	closed := r.closed
+	id := r.nextId
+	r.nextId += 1
+	r.live += 1
+	if !closed {
+		r.entries[id] = &registryEntry{conn, uri, direction, time.Now()}
+	}
+	r.unlock()
+	conn.addCloseHook(func() {
+		r.lock()
+		delete(r.entries, id)
+		r.unlock()
+		go func() {
+			<-conn.handshakeDone
+			r.lock()
+			defer r.unlock()
+			r.live -= 1
+			r.checkDrained()
+		}()
+	})
+	if closed {
+		conn.Close()
+		return false
+	}
+	return true
+}
+
+// Forbids adding of new connections.
+func (r *ConnRegistry) Close() {
+	r.lock()
+	defer r.unlock()
+	r.closed = true
+	r.checkDrained()
+}
+
+// Waits until registry is closed, all added connections are closed
+// and their handshake goroutines are finished.
+//
+// Returns ctx error if ctx is done before.
+func (r *ConnRegistry) Wait(ctx context.Context) error {
+	select {
+	case <-r.drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Returns count of live connections
+func (r *ConnRegistry) Len() int {
+	r.lock()
+	defer r.unlock()
+	return len(r.entries)
+}
+
+// Returns info about all live connections in order they were added.
+func (r *ConnRegistry) Connections() []ConnInfo {
+	r.lock()
+	ids := make([]uint64, 0, len(r.entries))
+	for id := range r.entries {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	entries := make([]*registryEntry, len(ids))
+	for i, id := range ids {
+		entries[i] = r.entries[id]
+	}
+	r.unlock()
+	ret := make([]ConnInfo, len(entries))
+	for i, entry := range entries {
+		ret[i] = entry.info()
+	}
+	return ret
+}
+
+// Returns info about live connections with node by its key.
+func (r *ConnRegistry) ConnectionsByKey(key ed25519.PublicKey) []ConnInfo {
+	ret := make([]ConnInfo, 0)
+	for _, info := range r.Connections() {
+		if info.PublicKey != nil && bytes.Compare(info.PublicKey, key) == 0 {
+			ret = append(ret, info)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,122 @@
+// Copyright 2022 DomesticMoth
+//
+// This file is part of Ytl.
+//
+// Ytl is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 3 of the License, or (at your option) any later version.
+//
+// Ytl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program; if not, write to the Free Software Foundation,
+// Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package ytl
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"github.com/DomesticMoth/ytl/debugstuff"
+	"github.com/DomesticMoth/ytl/static"
+	"io"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestConnManagerConnections(t *testing.T) {
+	transports := []static.Transport{
+		debugstuff.MockTransport{Scheme: "a", SecureLvl: 1},
+	}
+	manager := NewConnManagerWithTransports(
+		context.Background(),
+		nil,
+		nil,
+		nil,
+		nil,
+		transports,
+	)
+	key := debugstuff.MockPubKey()
+	uri, _ := url.Parse("a://host:123?mock_peer_key=" + hex.EncodeToString(key))
+	outbound, err := manager.Connect(*uri)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	listener, err := manager.Listen(*uri)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	inbound, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer inbound.Close()
+	header := make([]byte, 6+len(key))
+	for _, conn := range []*YggConn{outbound, inbound} {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			t.Fatalf("Error while reading from conn: %s", err)
+		}
+	}
+	conns := manager.Connections()
+	if len(conns) != 2 {
+		t.Fatalf("Wrong connections count %d", len(conns))
+	}
+	for i, direction := range []ConnDirection{DIRECTION_OUTBOUND, DIRECTION_INBOUND} {
+		info := conns[i]
+		if info.Direction != direction {
+			t.Errorf("Wrong direction %s %s", info.Direction, direction)
+		}
+		if bytes.Compare(info.PublicKey, key) != 0 {
+			t.Errorf("Wrong key")
+		}
+		if info.Version == nil || *info.Version != static.PROTO_VERSION() {
+			t.Errorf("Wrong version %s", info.Version)
+		}
+		if info.SecurityLevel != 1 {
+			t.Errorf("Wrong security lvl %d", info.SecurityLevel)
+		}
+		if info.BytesRead != uint64(len(header)) {
+			t.Errorf("Wrong bytes read counter %d", info.BytesRead)
+		}
+		if info.Uri.String() != uri.String() {
+			t.Errorf("Wrong uri %s", info.Uri.String())
+		}
+	}
+	if len(manager.ConnectionsByKey(key)) != 2 {
+		t.Errorf("Connections with key was not found")
+	}
+	if len(manager.ConnectionsByKey(make([]byte, len(key)))) != 0 {
+		t.Errorf("Connections with wrong key was found")
+	}
+	outbound.Close()
+	conns = manager.Connections()
+	if len(conns) != 1 || conns[0].Conn != inbound {
+		t.Errorf("Closed connection was not removed")
+	}
+}
+
+func TestConnRegistryWait(t *testing.T) {
+	registry := NewConnRegistry()
+	if !registry.Reserve() {
+		t.Fatalf("Open registry refused reservation")
+	}
+	registry.Close()
+	if registry.Reserve() {
+		t.Errorf("Closed registry accepted reservation")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := registry.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Wait returned before reservation was released: %v", err)
+	}
+	registry.Release()
+	if err := registry.Wait(context.Background()); err != nil {
+		t.Errorf("Unexpected wait error: %s", err)
+	}
+}
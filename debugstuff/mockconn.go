@@ -22,6 +22,9 @@ package debugstuff
 
 import (
 	"crypto/ed25519"
+	"encoding/binary"
+	"github.com/DomesticMoth/ytl/static"
+	"golang.org/x/crypto/blake2b"
 	"net"
 )
 
@@ -144,3 +147,100 @@ func MockTooShortConn() net.Conn {
 	}()
 	return a
 }
+
+// Size of mock v0.5 handshake package
+const MockV5MetaPackageSize = 123
+
+// Return valid ygg private key for debug usage with v0.5 mock connections
+func MockV5PrivKey() ed25519.PrivateKey {
+	seed := make([]byte, ed25519.SeedSize)
+	for i := range seed {
+		seed[i] = byte(i)
+	}
+	return ed25519.NewKeyFromSeed(seed)
+}
+
+// Return valid ygg pub key for debug usage with v0.5 mock connections
+func MockV5PubKey() []byte {
+	return MockV5PrivKey().Public().(ed25519.PublicKey)
+}
+
+// Builds v0.5 handshake package signed by key with optional password
+func MockV5MetaPackage(key ed25519.PrivateKey, version static.ProtoVersion, priority uint8, password []byte) []byte {
+	pub := key.Public().(ed25519.PublicKey)
+	buf := []byte{'m', 'e', 't', 'a', 0, 0}
+	field := func(op uint16, value []byte) {
+		buf = append(buf, 0, 0, 0, 0)
+		binary.BigEndian.PutUint16(buf[len(buf)-4:], op)
+		binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(len(value)))
+		buf = append(buf, value...)
+	}
+	field(static.META_VERSION_MAJOR, []byte{0, version.Major})
+	field(static.META_VERSION_MINOR, []byte{0, version.Minor})
+	field(static.META_PUBLIC_KEY, pub)
+	field(static.META_PRIORITY, []byte{priority})
+	hasher, _ := blake2b.New512(password)
+	hasher.Write(pub)
+	buf = append(buf, ed25519.Sign(key, hasher.Sum(nil))...)
+	binary.BigEndian.PutUint16(buf[4:6], uint16(len(buf)-6))
+	return buf
+}
+
+// Returns conn that writes content and then reads until closed
+func mockConnFromContent(content []byte) net.Conn {
+	a, b := net.Pipe()
+	go func() {
+		buf := make([]byte, 1)
+		b.Write(content)
+		for {
+			_, err := b.Read(buf)
+			if err != nil {
+				break
+			}
+		}
+		b.Close()
+	}()
+	return a
+}
+
+func MockConnV5Content() []byte {
+	content := MockV5MetaPackage(MockV5PrivKey(), static.PROTO_VERSION_0_5(), 1, nil)
+	return append(content, MockConnContent()[38:]...)
+}
+
+func MockV5Conn() net.Conn {
+	return mockConnFromContent(MockConnV5Content())
+}
+
+func MockConnV5WrongSignatureContent() []byte {
+	content := MockConnV5Content()
+	content[MockV5MetaPackageSize-1] ^= 0xff
+	return content
+}
+
+func MockV5WrongSignatureConn() net.Conn {
+	return mockConnFromContent(MockConnV5WrongSignatureContent())
+}
+
+func MockConnV5WrongVerContent() []byte {
+	content := MockV5MetaPackage(MockV5PrivKey(), static.ProtoVersion{Major: 0, Minor: 6}, 0, nil)
+	return append(content, MockConnContent()[38:]...)
+}
+
+func MockV5WrongVerConn() net.Conn {
+	return mockConnFromContent(MockConnV5WrongVerContent())
+}
+
+// Password used in password protected v0.5 mock connections
+func MockPassword() []byte {
+	return []byte("password")
+}
+
+func MockConnV5PasswordContent() []byte {
+	content := MockV5MetaPackage(MockV5PrivKey(), static.PROTO_VERSION_0_5(), 0, MockPassword())
+	return append(content, MockConnContent()[38:]...)
+}
+
+func MockV5PasswordConn() net.Conn {
+	return mockConnFromContent(MockConnV5PasswordContent())
+}
@@ -39,3 +39,10 @@ func TestMockPubKeyGeneration(t *testing.T) {
 		})
 	}
 }
+
+func TestMockV5MetaPackageSize(t *testing.T) {
+	pkg := MockV5MetaPackage(MockV5PrivKey(), static.PROTO_VERSION_0_5(), 0, nil)
+	if len(pkg) != MockV5MetaPackageSize {
+		t.Fatalf("Wrong mock v0.5 meta package size %d", len(pkg))
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"bytes"
 	"crypto/ed25519"
 	"encoding/hex"
+	"github.com/DomesticMoth/ytl/static"
 )
 
 func keyToStr(key ed25519.PublicKey) string {
@@ -42,6 +43,7 @@ type DeduplicationManager struct {
 	connId      uint64
 	secureMode  bool
 	blockKey    ed25519.PublicKey
+	logger      static.Logger
 }
 
 // If secureMode is disabled
@@ -54,7 +56,15 @@ type DeduplicationManager struct {
 func NewDeduplicationManager(secureMode bool, blockKey ed25519.PublicKey) *DeduplicationManager {
 	lock := make(chan struct{}, 1)
 	lock <- struct{}{}
-	return &DeduplicationManager{lock, make(map[string]connInfo), 0, secureMode, blockKey}
+	return &DeduplicationManager{lock, make(map[string]connInfo), 0, secureMode, blockKey, static.NopLogger{}}
+}
+
+// Sets logger that receives deduplication decisions.
+// Nil logger disables logging.
+//
+// It must be called before checking connections.
+func (d *DeduplicationManager) SetLogger(logger static.Logger) {
+	d.logger = static.LoggerOrNop(logger)
 }
 
 func (d *DeduplicationManager) lock() {
@@ -66,16 +76,13 @@ func (d *DeduplicationManager) unlock() {
 }
 
 // Callback
+// Forgets connection when it is closed.
 func (d *DeduplicationManager) onClose(strKey string, connId uint64) {
 	d.lock()
 	defer d.unlock()
 	if value, ok := d.connections[strKey]; ok {
 		if value.connId == connId {
-			closeMethod := value.closeMethod
 			delete(d.connections, strKey)
-			if closeMethod != nil {
-				closeMethod()
-			}
 		}
 	}
 }
@@ -90,33 +97,40 @@ func (d *DeduplicationManager) onClose(strKey string, connId uint64) {
 // connection MUST call on close.
 // If it is duplicate and if it must be closed returns nill.
 func (d *DeduplicationManager) Check(key ed25519.PublicKey, isSecure uint, closeMethod func()) func() {
+	evicted, onClose := d.check(key, isSecure, closeMethod)
+	// Evicted connection is closed outside the lock
+	// because it calls onClose while closing.
+	if evicted != nil {
+		evicted()
+	}
+	return onClose
+}
+
+// Does the Check work under the lock.
+// Returns close method of evicted connection (if any)
+// and callback for new connection.
+func (d *DeduplicationManager) check(key ed25519.PublicKey, isSecure uint, closeMethod func()) (func(), func()) {
 	d.lock()
 	defer d.unlock()
 	if d.blockKey != nil && bytes.Compare(d.blockKey, key) == 0 {
-		return nil
+		d.logger.Log(static.LOG_LEVEL_INFO, "Connection with blocked key rejected", "key", key)
+		return nil, nil
 	}
 	strKey := keyToStr(key)
+	var evicted func() = nil
 	if value, ok := d.connections[strKey]; ok {
-		if !d.secureMode {
-			return nil
-		}
-		if isSecure > value.isSecure {
-			if value.closeMethod != nil {
-				value.closeMethod()
-				value.closeMethod = nil
-			}
-			connId := d.connId
-			d.connId += 1
-			d.connections[strKey] = connInfo{
-				closeMethod,
-				isSecure,
-				connId,
-			}
-			return func() {
-				d.onClose(strKey, connId)
-			}
+		if !d.secureMode || isSecure <= value.isSecure {
+			d.logger.Log(
+				static.LOG_LEVEL_DEBUG, "Duplicate connection rejected",
+				"key", key, "security", isSecure, "existing_security", value.isSecure,
+			)
+			return nil, nil
 		}
-		return nil
+		d.logger.Log(
+			static.LOG_LEVEL_DEBUG, "Less secure duplicate connection evicted",
+			"key", key, "security", isSecure, "evicted_security", value.isSecure,
+		)
+		evicted = value.closeMethod
 	}
 	connId := d.connId
 	d.connId += 1
@@ -125,7 +139,7 @@ func (d *DeduplicationManager) Check(key ed25519.PublicKey, isSecure uint, close
 		isSecure,
 		connId,
 	}
-	return func() {
+	return evicted, func() {
 		d.onClose(strKey, connId)
 	}
 }
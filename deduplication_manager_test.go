@@ -107,3 +107,20 @@ func TestNoCollision(t *testing.T) {
 		t.Fatalf("Connection closed")
 	}
 }
+
+func TestCollisionAfterClose(t *testing.T) {
+	manager := NewDeduplicationManager(false, nil)
+	key := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	closeChn := make(chan int, 10)
+	cancel := manager.Check(key, 0, func() { closeChn <- 1 })
+	if cancel == nil {
+		t.Fatalf("Connection 1 was closed at the start")
+	}
+	cancel()
+	if manager.Check(key, 0, func() { closeChn <- 2 }) == nil {
+		t.Fatalf("Connection 2 was closed after connection 1 was closed")
+	}
+	if len(closeChn) > 0 {
+		t.Fatalf("Connection close callback was called")
+	}
+}
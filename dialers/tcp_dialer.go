@@ -20,20 +20,335 @@ package dialers
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/DomesticMoth/ytl/addr"
+	"github.com/DomesticMoth/ytl/static"
 	"golang.org/x/net/proxy"
 	"net"
 	"net/url"
+	"strings"
 	"syscall"
 	"time"
 )
 
+// Default values for TcpDialer options
+const (
+	DEFAULT_TIMEOUT       = 2 * time.Minute
+	DEFAULT_PROXY_TIMEOUT = 2 * time.Minute
+	DEFAULT_KEEP_ALIVE    = 15 * time.Second
+)
+
+// Names of uri params that override TcpDialer options.
+// Values are parsed with time.ParseDuration.
+const (
+	TIMEOUT_PARAM       = "timeout"
+	PROXY_TIMEOUT_PARAM = "proxy_timeout"
+	KEEP_ALIVE_PARAM    = "keepalive"
+)
+
 // Implemets options for connecting to tcp/ip address
 // with some extra features
 type TcpDialer struct {
-	Timeout   time.Duration `default:"2m"`
+	// Timeout of establishing tcp connection
+	// (to destination host or to proxy)
+	Timeout time.Duration `default:"2m"`
+	// Extra time for negotiation with proxy
+	// after connection to it is established
+	ProxyTimeout time.Duration `default:"2m"`
+	// Tcp keepalive period (negative value disables keepalive)
 	KeepAlive time.Duration `default:"15s"`
 	Control   func(network, address string, c syscall.RawConn) error
+	// Optional logger (nil means no logs)
+	Logger static.Logger
+	// Optional policy that destination address is checked with.
+	// If connection goes through proxy, only literal ip
+	// destination addresses can be checked.
+	Policy *static.Policy
+}
+
+// Returns duration from uri param or zero if param is not set.
+func DurationFromUri(uri url.URL, param string) (time.Duration, error) {
+	raw := uri.Query().Get(param)
+	if raw == "" {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, static.InvalidUriError{Err: fmt.Sprintf("%s param must be duration", param)}
+	}
+	return duration, nil
+}
+
+// Returns copy of dialer with options overridden
+// by non zero options of config.
+func (d TcpDialer) WithConfig(config static.DialConfig) TcpDialer {
+	if config.Timeout != 0 {
+		d.Timeout = config.Timeout
+	}
+	if config.ProxyTimeout != 0 {
+		d.ProxyTimeout = config.ProxyTimeout
+	}
+	if config.KeepAlive != 0 {
+		d.KeepAlive = config.KeepAlive
+	}
+	return d
+}
+
+// Returns copy of dialer with options overridden
+// by "timeout", "proxy_timeout" and "keepalive" uri params.
+func (d TcpDialer) WithUriParams(uri url.URL) (TcpDialer, error) {
+	for _, option := range []struct {
+		param string
+		value *time.Duration
+	}{
+		{TIMEOUT_PARAM, &d.Timeout},
+		{PROXY_TIMEOUT_PARAM, &d.ProxyTimeout},
+		{KEEP_ALIVE_PARAM, &d.KeepAlive},
+	} {
+		duration, err := DurationFromUri(uri, option.param)
+		if err != nil {
+			return d, err
+		}
+		if duration != 0 {
+			*option.value = duration
+		}
+	}
+	return d, nil
+}
+
+// Returns Timeout option or default value if it is not set
+func (d *TcpDialer) timeout() time.Duration {
+	if d.Timeout <= 0 {
+		return DEFAULT_TIMEOUT
+	}
+	return d.Timeout
+}
+
+// Returns ProxyTimeout option or default value if it is not set
+func (d *TcpDialer) proxyTimeout() time.Duration {
+	if d.ProxyTimeout <= 0 {
+		return DEFAULT_PROXY_TIMEOUT
+	}
+	return d.ProxyTimeout
+}
+
+// Returns KeepAlive option or default value if it is not set
+func (d *TcpDialer) keepAlive() time.Duration {
+	if d.KeepAlive == 0 {
+		return DEFAULT_KEEP_ALIVE
+	}
+	return d.KeepAlive
+}
+
+// Checks whether proxy scheme is supported by TcpDialer.
+func IsSupportedProxy(proxy_uri *url.URL) bool {
+	switch proxy_uri.Scheme {
+	case "socks", "socks5", "socks5h", "http", "https":
+		return true
+	}
+	return false
+}
+
+// Returns host:port of proxy.
+// If port is not set, default port of proxy scheme is used.
+func ProxyHost(proxy_uri *url.URL) string {
+	if proxy_uri.Port() != "" {
+		return proxy_uri.Host
+	}
+	port := "1080"
+	switch proxy_uri.Scheme {
+	case "http":
+		port = "80"
+	case "https":
+		port = "443"
+	}
+	return net.JoinHostPort(proxy_uri.Hostname(), port)
+}
+
+// Returns dialer that connects through proxy at addr
+// using forward dialer to reach the proxy.
+//
+// Supported proxy schemes are "socks", "socks5", "socks5h",
+// "http" and "https" (CONNECT method).
+func newProxyDialer(proxy_uri *url.URL, addr string, forward proxy.Dialer) (proxy.Dialer, error) {
+	switch proxy_uri.Scheme {
+	case "socks", "socks5", "socks5h":
+		var auth *proxy.Auth = nil
+		if proxy_uri.User != nil {
+			auth = &proxy.Auth{User: proxy_uri.User.Username()}
+			auth.Password, _ = proxy_uri.User.Password()
+		}
+		return proxy.SOCKS5("tcp", addr, auth, forward)
+	case "http", "https":
+		return &httpProxyDialer{*proxy_uri, addr, forward}, nil
+	}
+	return nil, static.InapplicableProxyTypeError{Proxy: *proxy_uri}
+}
+
+// Dialer that drops ygg over ygg connections.
+// Literal ip of destination is checked before dialing,
+// local and remote addresses of connection are checked after it.
+type checkedDialer struct {
+	forward proxy.Dialer
+}
+
+func (c checkedDialer) Dial(network, address string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, address)
+}
+
+func (c checkedDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if err = addr.CheckAddr(ip); err != nil {
+			return nil, err
+		}
+	}
+	var conn net.Conn
+	if forward, ok := c.forward.(proxy.ContextDialer); ok {
+		conn, err = forward.DialContext(ctx, network, address)
+	} else {
+		conn, err = c.forward.Dial(network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	laddr, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	raddr, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if err = addr.CheckAddr(net.ParseIP(laddr)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err = addr.CheckAddr(net.ParseIP(raddr)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Dialer of the first proxy in chain.
+// Wraps errors to static.ProxyError,
+// so they can be distinguished from errors of next hops.
+type proxyErrorDialer struct {
+	proxy   string
+	forward *net.Dialer
+}
+
+func (p proxyErrorDialer) Dial(network, address string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, address)
+}
+
+func (p proxyErrorDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := p.forward.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, static.ProxyError{Proxy: p.proxy, Err: err}
+	}
+	return conn, nil
+}
+
+// Reply of proxy that destination can not be reached through it.
+// It is not a failure of proxy itself.
+type destinationError struct {
+	err error
+}
+
+func (e destinationError) Error() string { return e.err.Error() }
+
+func (e destinationError) Unwrap() error { return e.err }
+
+// Replies of socks proxy about unreachable destination
+var socksDestinationReplies = []string{
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+}
+
+// Checks whether negotiation with proxy failed
+// because destination is unreachable through it.
+func isDestinationError(err error) bool {
+	var destErr destinationError
+	if errors.As(err, &destErr) {
+		return true
+	}
+	// Socks replies are available only as error text
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && strings.HasPrefix(opErr.Op, "socks") && opErr.Err != nil {
+		for _, reply := range socksDestinationReplies {
+			if opErr.Err.Error() == "unknown error "+reply {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Negotiates with the first proxy in chain.
+// Wraps errors to static.ProxyError,
+// except replies that destination is unreachable,
+// so broken proxies can be distinguished from unreachable destinations.
+type proxyNegotiationDialer struct {
+	proxy   string
+	forward proxy.Dialer
+}
+
+func (p proxyNegotiationDialer) Dial(network, address string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, address)
+}
+
+func (p proxyNegotiationDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if forward, ok := p.forward.(proxy.ContextDialer); ok {
+		conn, err = forward.DialContext(ctx, network, address)
+	} else {
+		conn, err = p.forward.Dial(network, address)
+	}
+	if err != nil {
+		var proxyErr static.ProxyError
+		var addrErr static.UnacceptableAddressError
+		if errors.As(err, &proxyErr) || errors.As(err, &addrErr) ||
+			isDestinationError(err) || errors.Is(err, context.Canceled) {
+			return nil, err
+		}
+		return nil, static.ProxyError{Proxy: p.proxy, Err: err}
+	}
+	return conn, nil
+}
+
+// Resolves and checks address of the first proxy in chain.
+// Returns it with dialer that connects to it.
+func (d *TcpDialer) firstHop(proxy_uri *url.URL) (*net.TCPAddr, proxy.Dialer, error) {
+	dst, err := net.ResolveTCPAddr("tcp", ProxyHost(proxy_uri))
+	if err != nil {
+		return nil, nil, static.ProxyError{Proxy: proxy_uri.Redacted(), Err: err}
+	}
+	if err = addr.CheckAddr(dst.IP); err != nil {
+		return nil, nil, err
+	}
+	return dst, proxyErrorDialer{proxy_uri.Redacted(), &net.Dialer{
+		Timeout:   d.timeout(),
+		KeepAlive: d.keepAlive(),
+		Control:   d.Control,
+	}}, nil
+}
+
+// Checks that tcp connection with proxy can be established.
+// Proxy is dialed in the same way as the first proxy of chain
+// in DialChainContext, so ygg over ygg connections are dropped.
+func (d *TcpDialer) ProbeProxy(ctx context.Context, proxy_uri *url.URL) error {
+	dst, dialer, err := d.firstHop(proxy_uri)
+	if err != nil {
+		return err
+	}
+	conn, err := checkedDialer{dialer}.DialContext(ctx, "tcp", dst.String())
+	if err != nil {
+		return err
+	}
+	return conn.Close()
 }
 
 // Dial connects to the address by url with optional using proxy (if not nil).
@@ -46,63 +361,102 @@ func (d *TcpDialer) Dial(uri url.URL, proxy *url.URL) (net.Conn, error) {
 // It also drops ygg over ygg connections.
 // It also accepts a context that allows you to
 // cancel the process of settling ahead of time.
+//
+// Socks and http(s) CONNECT proxies are supported,
+// other proxy schemes return static.InapplicableProxyTypeError.
 func (d *TcpDialer) DialContext(ctx context.Context, uri url.URL, proxy_uri *url.URL) (net.Conn, error) {
+	if proxy_uri == nil {
+		return d.DialChainContext(ctx, uri, nil)
+	}
+	return d.DialChainContext(ctx, uri, []*url.URL{proxy_uri})
+}
+
+// Dial connects to the address by url through chain of proxies.
+// Connection to every next proxy is opened through previous one,
+// the last proxy connects to the address.
+// Empty chain means direct connection.
+//
+// Ygg over ygg check is done for every hop.
+// Only the first proxy address is resolved locally,
+// addresses of next hops are checked if they are literal ip addresses.
+func (d *TcpDialer) DialChainContext(ctx context.Context, uri url.URL, chain []*url.URL) (net.Conn, error) {
 	// Clean code? Cyclomatic complexity?
 	// I dont know these buzzwords
-	use_proxy := false
-	if proxy_uri != nil {
-		use_proxy = proxy_uri.Scheme == "socks" || proxy_uri.Scheme == "socks5" || proxy_uri.Scheme == "socks5h"
-	}
-	if use_proxy {
-		dialerdst, err := net.ResolveTCPAddr("tcp", proxy_uri.Host)
-		if err != nil {
-			return nil, err
+	logger := static.LoggerOrNop(d.Logger)
+	if len(chain) > 0 {
+		for _, proxy_uri := range chain {
+			if !IsSupportedProxy(proxy_uri) {
+				return nil, static.InapplicableProxyTypeError{Transport: uri.Scheme, Proxy: *proxy_uri}
+			}
 		}
-		if err = addr.CheckAddr(dialerdst.IP); err != nil {
-			return nil, err
+		if ip := net.ParseIP(uri.Hostname()); ip != nil {
+			if err := d.Policy.CheckIp(ip); err != nil {
+				return nil, err
+			}
 		}
-		auth := &proxy.Auth{}
-		if proxy_uri.User != nil {
-			auth.User = proxy_uri.User.Username()
-			auth.Password, _ = proxy_uri.User.Password()
+		proxies := make([]string, len(chain))
+		for i, proxy_uri := range chain {
+			proxies[i] = proxy_uri.Redacted()
 		}
-		innerDialer, err := proxy.SOCKS5("tcp", dialerdst.String(), auth, proxy.Direct)
+		logger.Log(
+			static.LOG_LEVEL_DEBUG, "Dialing via proxy",
+			"uri", static.RedactUri(uri).String(), "proxy", strings.Join(proxies, " -> "),
+		)
+		dialerdst, innerDialer, err := d.firstHop(chain[0])
 		if err != nil {
 			return nil, err
 		}
-		ctx, cancel := context.WithTimeout(ctx, d.Timeout)
-		conn, err := innerDialer.(proxy.ContextDialer).DialContext(ctx, "tcp", uri.Host)
+		for i, proxy_uri := range chain {
+			hop := dialerdst.String()
+			if i > 0 {
+				hop = ProxyHost(proxy_uri)
+			}
+			innerDialer, err = newProxyDialer(proxy_uri, hop, checkedDialer{innerDialer})
+			if err != nil {
+				return nil, static.DialError{Addr: proxy_uri.Host, Err: err}
+			}
+			if i == 0 {
+				innerDialer = proxyNegotiationDialer{proxy_uri.Redacted(), innerDialer}
+			}
+		}
+		ctx, cancel := context.WithTimeout(ctx, d.timeout()+time.Duration(len(chain))*d.proxyTimeout())
+		conn, err := checkedDialer{innerDialer}.DialContext(ctx, "tcp", uri.Host)
 		cancel()
 		if err != nil {
-			return nil, err
-		}
-		laddr, _, _ := net.SplitHostPort(conn.LocalAddr().String())
-		raddr, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
-		if err = addr.CheckAddr(net.ParseIP(laddr)); err != nil {
-			conn.Close()
-			return nil, err
+			var addrErr static.UnacceptableAddressError
+			if errors.As(err, &addrErr) {
+				return nil, addrErr
+			}
+			var proxyErr static.ProxyError
+			if errors.As(err, &proxyErr) {
+				return nil, proxyErr
+			}
+			return nil, static.DialError{Addr: uri.Host, Err: err}
 		}
-		if err = addr.CheckAddr(net.ParseIP(raddr)); err != nil {
-			conn.Close()
-			return nil, err
-		}
-		return conn, err
+		return conn, nil
 	} else {
 		dst, err := net.ResolveTCPAddr("tcp", uri.Host)
 		if err != nil {
-			return nil, err
+			return nil, static.DialError{Addr: uri.Host, Err: err}
 		}
 		if err = addr.CheckAddr(dst.IP); err != nil {
 			return nil, err
 		}
+		if err = d.Policy.CheckIp(dst.IP); err != nil {
+			return nil, err
+		}
 		innerDialer := net.Dialer{
-			Timeout:   d.Timeout,
-			KeepAlive: d.KeepAlive,
+			Timeout:   d.timeout(),
+			KeepAlive: d.keepAlive(),
 			Control:   d.Control,
 		}
-		ctx, cancel := context.WithTimeout(ctx, d.Timeout)
+		logger.Log(static.LOG_LEVEL_DEBUG, "Dialing", "uri", static.RedactUri(uri).String(), "addr", dst.String())
+		ctx, cancel := context.WithTimeout(ctx, d.timeout())
 		conn, err := innerDialer.DialContext(ctx, "tcp", dst.String())
 		cancel()
-		return conn, err
+		if err != nil {
+			return nil, static.DialError{Addr: uri.Host, Err: err}
+		}
+		return conn, nil
 	}
 }
@@ -19,11 +19,19 @@
 package dialers
 
 import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
 	"github.com/DomesticMoth/ytl/static"
 	"github.com/foxcpp/go-mockdns"
+	"io"
 	"net"
+	"net/http"
 	"net/url"
+	"syscall"
 	"testing"
+	"time"
 )
 
 // Checking that ygg over ygg connections are rejected
@@ -74,3 +82,334 @@ func TestTcpDialerLoopRoutingProtectionWithDns(t *testing.T) {
 	testTcpDialerLoopRoutingProtection(t, *normal_addr, nil, false)
 	testTcpDialerLoopRoutingProtection(t, *normal_addr, normal_proxy, false)
 }
+
+func TestTcpDialerWithUriParams(t *testing.T) {
+	dialer := TcpDialer{Timeout: time.Second, KeepAlive: time.Second}
+	uri, _ := url.Parse("tcp://localhost:1000?timeout=5s&proxy_timeout=1m&keepalive=-1s")
+	configured, err := dialer.WithUriParams(*uri)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if configured.Timeout != time.Second*5 ||
+		configured.ProxyTimeout != time.Minute ||
+		configured.KeepAlive != -time.Second {
+		t.Errorf("Options were not overridden %v", configured)
+	}
+	if dialer.Timeout != time.Second {
+		t.Errorf("Original dialer was changed")
+	}
+	uri, _ = url.Parse("tcp://localhost:1000")
+	configured, err = dialer.WithUriParams(*uri)
+	if err != nil || configured.Timeout != time.Second || configured.KeepAlive != time.Second {
+		t.Errorf("Options without uri params must not be changed")
+	}
+	uri, _ = url.Parse("tcp://localhost:1000?timeout=abc")
+	if _, err = dialer.WithUriParams(*uri); err == nil {
+		t.Errorf("Invalid duration should cause an error")
+	}
+}
+
+func TestTcpDialerWithConfig(t *testing.T) {
+	dialer := TcpDialer{Timeout: time.Second, KeepAlive: time.Second}
+	configured := dialer.WithConfig(static.DialConfig{Timeout: time.Second * 5, ProxyTimeout: time.Minute})
+	if configured.Timeout != time.Second*5 ||
+		configured.ProxyTimeout != time.Minute ||
+		configured.KeepAlive != time.Second {
+		t.Errorf("Options were not overridden by config %v", configured)
+	}
+	// Uri params override config
+	uri, _ := url.Parse("tcp://localhost:1000?timeout=10s")
+	configured, err := configured.WithUriParams(*uri)
+	if err != nil || configured.Timeout != time.Second*10 {
+		t.Errorf("Config was not overridden by uri params %v", configured)
+	}
+}
+
+func TestTcpDialerPolicy(t *testing.T) {
+	nets, err := static.ParseCIDRs("127.0.0.0/8", "::1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	dialer := TcpDialer{Policy: &static.Policy{DenyNets: nets}}
+	for _, raw := range []string{"tcp://127.0.0.1:1", "tcp://[::1]:1"} {
+		uri, _ := url.Parse(raw)
+		if _, err := dialer.Dial(*uri, nil); !errors.Is(err, static.ErrUnacceptableAddress) {
+			t.Errorf("Denied address %s was dialed: %s", raw, err)
+		}
+	}
+	proxy, _ := url.Parse("socks://localhost:1")
+	uri, _ := url.Parse("tcp://127.0.0.2:1")
+	if _, err := dialer.Dial(*uri, proxy); !errors.Is(err, static.ErrUnacceptableAddress) {
+		t.Errorf("Denied address was dialed via proxy: %s", err)
+	}
+}
+
+// Starts http proxy that accepts one CONNECT request
+// and answers with status and early data.
+// Received request is sent to returned channel.
+func startHttpProxy(t *testing.T, status string, early string) (net.Listener, chan *http.Request) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	requests := make(chan *http.Request, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		requests <- req
+		conn.Write([]byte("HTTP/1.1 " + status + "\r\n\r\n" + early))
+		io.Copy(io.Discard, conn)
+	}()
+	return listener, requests
+}
+
+func TestTcpDialerHttpProxy(t *testing.T) {
+	listener, requests := startHttpProxy(t, "200 Connection established", "hello")
+	defer listener.Close()
+	proxy, _ := url.Parse("http://user:secret@" + listener.Addr().String())
+	uri, _ := url.Parse("tcp://example.com:1234")
+	dialer := TcpDialer{Timeout: time.Second * 5}
+	conn, err := dialer.Dial(*uri, proxy)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer conn.Close()
+	req := <-requests
+	if req.Method != http.MethodConnect || req.Host != "example.com:1234" {
+		t.Errorf("Wrong request %s %s", req.Method, req.Host)
+	}
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	if req.Header.Get("Proxy-Authorization") != auth {
+		t.Errorf("Wrong auth header %q", req.Header.Get("Proxy-Authorization"))
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("Data sent with proxy response is lost: %q %v", buf, err)
+	}
+}
+
+func TestTcpDialerHttpProxyRefused(t *testing.T) {
+	listener, _ := startHttpProxy(t, "407 Proxy Authentication Required", "")
+	defer listener.Close()
+	proxy, _ := url.Parse("http://" + listener.Addr().String())
+	uri, _ := url.Parse("tcp://example.com:1234")
+	dialer := TcpDialer{Timeout: time.Second * 5}
+	if _, err := dialer.Dial(*uri, proxy); !errors.Is(err, static.ErrDial) {
+		t.Errorf("Refused connection must return dial error: %v", err)
+	}
+}
+
+func TestTcpDialerUnsupportedProxy(t *testing.T) {
+	proxy, _ := url.Parse("ftp://localhost:1")
+	uri, _ := url.Parse("tcp://127.0.0.1:1")
+	dialer := TcpDialer{}
+	_, err := dialer.Dial(*uri, proxy)
+	var e static.InapplicableProxyTypeError
+	if !errors.As(err, &e) || e.Transport != "tcp" || !errors.Is(err, static.ErrInapplicableProxy) {
+		t.Errorf("Unsupported proxy must be rejected: %v", err)
+	}
+}
+
+// Starts http proxy that tunnels CONNECT requests.
+// Hosts of received requests are sent to returned channel.
+func startTunnelProxy(t *testing.T) (net.Listener, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	hosts := make(chan string, 16)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				req, err := http.ReadRequest(reader)
+				if err != nil {
+					return
+				}
+				hosts <- req.Host
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+					return
+				}
+				defer target.Close()
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				go io.Copy(target, reader)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return listener, hosts
+}
+
+func TestTcpDialerProxyChain(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err == nil {
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+	first, firstHosts := startTunnelProxy(t)
+	defer first.Close()
+	second, secondHosts := startTunnelProxy(t)
+	defer second.Close()
+	chain := make([]*url.URL, 2)
+	chain[0], _ = url.Parse("http://" + first.Addr().String())
+	chain[1], _ = url.Parse("http://" + second.Addr().String())
+	uri, _ := url.Parse("tcp://" + target.Addr().String())
+	dialer := TcpDialer{Timeout: time.Second * 5}
+	conn, err := dialer.DialChainContext(context.Background(), *uri, chain)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("Wrong data from chained connection: %q %v", buf, err)
+	}
+	if host := <-firstHosts; host != second.Addr().String() {
+		t.Errorf("First proxy connected to %s", host)
+	}
+	if host := <-secondHosts; host != target.Addr().String() {
+		t.Errorf("Second proxy connected to %s", host)
+	}
+	// Ygg address of the next hop must be rejected
+	// before it is requested from previous proxy
+	chain[1], _ = url.Parse("socks://[202:a029:6fa0:f079:7fc:646f:cd3b:6248]:1080")
+	_, err = dialer.DialChainContext(context.Background(), *uri, chain)
+	if !errors.Is(err, static.ErrUnacceptableAddress) {
+		t.Errorf("Ygg over ygg hop was not rejected: %v", err)
+	}
+	select {
+	case host := <-firstHosts:
+		t.Errorf("Ygg hop %s was requested from proxy", host)
+	default:
+	}
+	chain[1], _ = url.Parse("ftp://localhost:1")
+	if _, err = dialer.DialChainContext(context.Background(), *uri, chain); !errors.Is(err, static.ErrInapplicableProxy) {
+		t.Errorf("Unsupported proxy in chain was not rejected: %v", err)
+	}
+}
+
+func TestTcpDialerProxyError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// Nobody listens on this port anymore
+	listener.Close()
+	proxy, _ := url.Parse("socks://" + listener.Addr().String())
+	uri, _ := url.Parse("tcp://example.com:1234")
+	dialer := TcpDialer{Timeout: time.Second * 5}
+	if _, err := dialer.Dial(*uri, proxy); !errors.Is(err, static.ErrProxy) || !errors.Is(err, static.ErrDial) {
+		t.Errorf("Unreachable proxy must return proxy error: %v", err)
+	}
+	// Failed negotiation is error of proxy
+	refused, _ := startHttpProxy(t, "407 Proxy Authentication Required", "")
+	defer refused.Close()
+	proxy, _ = url.Parse("http://" + refused.Addr().String())
+	if _, err := dialer.Dial(*uri, proxy); !errors.Is(err, static.ErrProxy) {
+		t.Errorf("Failed negotiation must return proxy error: %v", err)
+	}
+	noAuth := startSocksProxy(t, 0xff, 0)
+	defer noAuth.Close()
+	proxy, _ = url.Parse("socks://" + noAuth.Addr().String())
+	if _, err := dialer.Dial(*uri, proxy); !errors.Is(err, static.ErrProxy) {
+		t.Errorf("Failed negotiation must return proxy error: %v", err)
+	}
+	// Unreachable destination is not error of proxy
+	badGateway, _ := startHttpProxy(t, "502 Bad Gateway", "")
+	defer badGateway.Close()
+	proxy, _ = url.Parse("http://" + badGateway.Addr().String())
+	if _, err := dialer.Dial(*uri, proxy); errors.Is(err, static.ErrProxy) || !errors.Is(err, static.ErrDial) {
+		t.Errorf("Unreachable destination must return dial error: %v", err)
+	}
+	hostUnreachable := startSocksProxy(t, 0, 4)
+	defer hostUnreachable.Close()
+	proxy, _ = url.Parse("socks://" + hostUnreachable.Addr().String())
+	if _, err := dialer.Dial(*uri, proxy); errors.Is(err, static.ErrProxy) || !errors.Is(err, static.ErrDial) {
+		t.Errorf("Unreachable destination must return dial error: %v", err)
+	}
+}
+
+// Starts socks5 proxy that selects passed auth method
+// and answers to connect request with passed reply code.
+// If method is 0xff, connect request is not read.
+func startSocksProxy(t *testing.T, method byte, reply byte) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(reader, head); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(reader, make([]byte, head[1])); err != nil {
+			return
+		}
+		conn.Write([]byte{5, method})
+		if method == 0xff {
+			return
+		}
+		// Version, command, reserved, address type, domain length
+		req := make([]byte, 5)
+		if _, err := io.ReadFull(reader, req); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(reader, make([]byte, int(req[4])+2)); err != nil {
+			return
+		}
+		conn.Write([]byte{5, reply, 0, 1, 0, 0, 0, 0, 0, 0})
+		io.Copy(io.Discard, reader)
+	}()
+	return listener
+}
+
+func TestTcpDialerProbeProxy(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer listener.Close()
+	controlled := false
+	dialer := TcpDialer{Control: func(network, address string, c syscall.RawConn) error {
+		controlled = true
+		return nil
+	}}
+	proxy, _ := url.Parse("socks://" + listener.Addr().String())
+	if err := dialer.ProbeProxy(context.Background(), proxy); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if !controlled {
+		t.Errorf("Control of dialer was not applied")
+	}
+	proxy, _ = url.Parse("socks://[200::1]:1080")
+	if err := dialer.ProbeProxy(context.Background(), proxy); !errors.Is(err, static.ErrUnacceptableAddress) {
+		t.Errorf("Proxy in ygg network was probed: %v", err)
+	}
+}
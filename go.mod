@@ -5,5 +5,6 @@ go 1.16
 require (
 	github.com/foxcpp/go-mockdns v1.0.0
 	github.com/yggdrasil-network/yggdrasil-go v0.4.4
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
 	golang.org/x/net v0.0.0-20220805013720-a33c5aa5df48
 )
@@ -0,0 +1,137 @@
+// Copyright 2022 DomesticMoth
+//
+// This file is part of Ytl.
+//
+// Ytl is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 3 of the License, or (at your option) any later version.
+//
+// Ytl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program; if not, write to the Free Software Foundation,
+// Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package ytl
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"github.com/DomesticMoth/ytl/debugstuff"
+	"github.com/DomesticMoth/ytl/static"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Buffer that is safe for concurrent use
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func TestStdLogger(t *testing.T) {
+	buf := &syncBuffer{}
+	logger := static.StdLogger{Logger: log.New(buf, "", 0), Level: static.LOG_LEVEL_INFO}
+	logger.Log(static.LOG_LEVEL_DEBUG, "Hidden")
+	logger.Log(static.LOG_LEVEL_WARN, "Shown", "key", debugstuff.MockPubKey(), "odd")
+	expected := "WARN Shown key=" + hex.EncodeToString(debugstuff.MockPubKey()) + " odd=MISSING\n"
+	if buf.String() != expected {
+		t.Errorf("Wrong log output %q", buf.String())
+	}
+}
+
+func TestConnManagerLogger(t *testing.T) {
+	transports := []static.Transport{
+		debugstuff.MockTransport{Scheme: "a", SecureLvl: 0},
+	}
+	manager := NewConnManagerWithTransports(
+		context.Background(),
+		nil,
+		nil,
+		NewDeduplicationManager(false, debugstuff.MockPubKey()),
+		nil,
+		transports,
+	)
+	buf := &syncBuffer{}
+	manager.SetLogger(static.StdLogger{Logger: log.New(buf, "", 0)})
+	key := hex.EncodeToString(debugstuff.MockPubKey())
+	uri, _ := url.Parse("a://host:123?mock_peer_key=" + key)
+	conn, err := manager.Connect(*uri)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer conn.Close()
+	select {
+	case <-conn.Done():
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Connection with blocked key was not closed")
+	}
+	output := buf.String()
+	for _, line := range []string{
+		"INFO Connection with blocked key rejected key=" + key,
+		"INFO Connection rejected uri=" + uri.String(),
+		"DEBUG Connection closed uri=" + uri.String(),
+	} {
+		if !strings.Contains(output, line) {
+			t.Errorf("Log does not contain %q:\n%s", line, output)
+		}
+	}
+}
+
+func TestConnManagerLoggerRedactsPassword(t *testing.T) {
+	transports := []static.Transport{
+		debugstuff.MockTransport{Scheme: "a", SecureLvl: 0},
+	}
+	manager := NewConnManagerWithTransports(
+		context.Background(),
+		nil,
+		nil,
+		nil,
+		nil,
+		transports,
+	)
+	defer manager.Close()
+	buf := &syncBuffer{}
+	manager.SetLogger(static.StdLogger{Logger: log.New(buf, "", 0)})
+	observer := recordingObserver{make(chan recordedEvent, 16)}
+	manager.AddObserver(observer)
+	uri, _ := url.Parse("a://user:secret@host:123?password=secret")
+	conn, err := manager.Connect(*uri)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	conn.Close()
+	if !strings.Contains(buf.String(), "uri=a://user:xxxxx@host:123") {
+		t.Errorf("Log does not contain redacted uri:\n%s", buf.String())
+	}
+	if strings.Contains(buf.String(), "secret") {
+		t.Errorf("Log contains password:\n%s", buf.String())
+	}
+	for len(observer.events) > 0 {
+		e := <-observer.events
+		if strings.Contains(e.event.Uri.String(), "secret") {
+			t.Errorf("Observer event %s contains password: %s", e.name, e.event.Uri.String())
+		}
+	}
+}
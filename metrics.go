@@ -0,0 +1,233 @@
+// Copyright 2022 DomesticMoth
+//
+// This file is part of Ytl.
+//
+// Ytl is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 3 of the License, or (at your option) any later version.
+//
+// Ytl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program; if not, write to the Free Software Foundation,
+// Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package ytl
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/DomesticMoth/ytl/static"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Upper bounds (in seconds) of dial latency histogram buckets
+var DEFAULT_DIAL_BUCKETS = []float64{
+	0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60,
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Collects connection and handshake metrics of ConnManager
+// and exposes them in prometheus text exposition format.
+//
+// It implements http.Handler, so it can be scraped directly.
+//
+//	metrics := ytl.NewMetrics(manager)
+//	http.Handle("/metrics", metrics)
+//
+// Exported metrics:
+//   - ytl_active_connections{scheme} gauge
+//   - ytl_handshake_successes_total counter
+//   - ytl_handshake_failures_total{error} counter
+//   - ytl_dedup_evictions_total counter
+//   - ytl_bytes_read_total and ytl_bytes_written_total counters
+//   - ytl_dial_duration_seconds{scheme} histogram
+type Metrics struct {
+	NopObserver
+	manager           *ConnManager
+	buckets           []float64
+	lockChan          chan struct{}
+	handshakes        uint64
+	handshakeFailures map[string]uint64
+	dedupEvictions    uint64
+	closedBytesRead   uint64
+	closedBytesWrite  uint64
+	lastBytesRead     uint64
+	lastBytesWrite    uint64
+	dials             map[string]*histogram
+}
+
+// Creates Metrics and registers it as observer of manager.
+func NewMetrics(manager *ConnManager) *Metrics {
+	lock := make(chan struct{}, 1)
+	lock <- struct{}{}
+	m := &Metrics{
+		manager:           manager,
+		buckets:           DEFAULT_DIAL_BUCKETS,
+		lockChan:          lock,
+		handshakeFailures: make(map[string]uint64),
+		dials:             make(map[string]*histogram),
+	}
+	manager.AddObserver(m)
+	return m
+}
+
+func (m *Metrics) lock() {
+	<-m.lockChan
+}
+
+func (m *Metrics) unlock() {
+	m.lockChan <- struct{}{}
+}
+
+// Returns label for error.
+// Errors from static package are labeled by type name,
+// all others are labeled as "other".
+func errorLabel(err error) string {
+	t := reflect.TypeOf(err)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.PkgPath() != "github.com/DomesticMoth/ytl/static" {
+		return "other"
+	}
+	return t.Name()
+}
+
+// Returns true if established connection was evicted by deduplicator.
+// Rejected new duplicates are not counted.
+func isDedupEviction(err error) bool {
+	e, ok := err.(static.ConnClosedByDeduplicatorError)
+	return ok && e.Evicted
+}
+
+func (m *Metrics) OnDial(event ConnEvent) {
+	m.lock()
+	defer m.unlock()
+	h, ok := m.dials[event.Uri.Scheme]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.buckets))}
+		m.dials[event.Uri.Scheme] = h
+	}
+	seconds := event.Duration.Seconds()
+	for i, bound := range m.buckets {
+		if seconds <= bound {
+			h.counts[i] += 1
+		}
+	}
+	h.sum += seconds
+	h.count += 1
+}
+
+func (m *Metrics) OnHandshake(event ConnEvent) {
+	m.lock()
+	defer m.unlock()
+	m.handshakes += 1
+}
+
+func (m *Metrics) OnReject(event ConnEvent, reason error) {
+	m.lock()
+	defer m.unlock()
+	m.handshakeFailures[errorLabel(reason)] += 1
+}
+
+func (m *Metrics) OnClose(event ConnEvent) {
+	m.lock()
+	defer m.unlock()
+	if isDedupEviction(event.Err) {
+		m.dedupEvictions += 1
+	}
+	m.closedBytesRead += event.BytesRead
+	m.closedBytesWrite += event.BytesWritten
+}
+
+// Escapes label value for text exposition format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Writes all metrics in prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	active := make(map[string]uint64)
+	var liveRead, liveWrite uint64
+	for _, info := range m.manager.Connections() {
+		active[info.Uri.Scheme] += 1
+		liveRead += info.BytesRead
+		liveWrite += info.BytesWritten
+	}
+	var buf bytes.Buffer
+	m.lock()
+	// Connection may be already removed from registry
+	// but not yet reported as closed,
+	// so counters are kept monotonic explicitly.
+	if read := m.closedBytesRead + liveRead; read > m.lastBytesRead {
+		m.lastBytesRead = read
+	}
+	if write := m.closedBytesWrite + liveWrite; write > m.lastBytesWrite {
+		m.lastBytesWrite = write
+	}
+	writeHeader(&buf, "ytl_active_connections", "gauge", "Number of open connections.")
+	for _, scheme := range sortedKeys(active) {
+		fmt.Fprintf(&buf, "ytl_active_connections{scheme=\"%s\"} %d\n", labelEscaper.Replace(scheme), active[scheme])
+	}
+	writeHeader(&buf, "ytl_handshake_successes_total", "counter", "Number of successful handshakes.")
+	fmt.Fprintf(&buf, "ytl_handshake_successes_total %d\n", m.handshakes)
+	writeHeader(&buf, "ytl_handshake_failures_total", "counter", "Number of rejected connections by error type.")
+	for _, label := range sortedKeys(m.handshakeFailures) {
+		fmt.Fprintf(&buf, "ytl_handshake_failures_total{error=\"%s\"} %d\n", labelEscaper.Replace(label), m.handshakeFailures[label])
+	}
+	writeHeader(&buf, "ytl_dedup_evictions_total", "counter", "Number of connections closed by deduplicator.")
+	fmt.Fprintf(&buf, "ytl_dedup_evictions_total %d\n", m.dedupEvictions)
+	writeHeader(&buf, "ytl_bytes_read_total", "counter", "Number of bytes read from connections.")
+	fmt.Fprintf(&buf, "ytl_bytes_read_total %d\n", m.lastBytesRead)
+	writeHeader(&buf, "ytl_bytes_written_total", "counter", "Number of bytes written to connections.")
+	fmt.Fprintf(&buf, "ytl_bytes_written_total %d\n", m.lastBytesWrite)
+	writeHeader(&buf, "ytl_dial_duration_seconds", "histogram", "Duration of transport dials.")
+	schemes := make([]string, 0, len(m.dials))
+	for scheme := range m.dials {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	for _, scheme := range schemes {
+		h := m.dials[scheme]
+		label := labelEscaper.Replace(scheme)
+		for i, bound := range m.buckets {
+			fmt.Fprintf(&buf, "ytl_dial_duration_seconds_bucket{scheme=\"%s\",le=\"%g\"} %d\n", label, bound, h.counts[i])
+		}
+		fmt.Fprintf(&buf, "ytl_dial_duration_seconds_bucket{scheme=\"%s\",le=\"+Inf\"} %d\n", label, h.count)
+		fmt.Fprintf(&buf, "ytl_dial_duration_seconds_sum{scheme=\"%s\"} %g\n", label, h.sum)
+		fmt.Fprintf(&buf, "ytl_dial_duration_seconds_count{scheme=\"%s\"} %d\n", label, h.count)
+	}
+	m.unlock()
+	return buf.WriteTo(w)
+}
+
+// Serves metrics in prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
@@ -0,0 +1,157 @@
+// Copyright 2022 DomesticMoth
+//
+// This file is part of Ytl.
+//
+// Ytl is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 3 of the License, or (at your option) any later version.
+//
+// Ytl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program; if not, write to the Free Software Foundation,
+// Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package ytl
+
+import (
+	"context"
+	"encoding/hex"
+	"github.com/DomesticMoth/ytl/debugstuff"
+	"github.com/DomesticMoth/ytl/static"
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func waitDone(t *testing.T, conn *YggConn) {
+	select {
+	case <-conn.Done():
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Connection was not closed")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	transports := []static.Transport{
+		debugstuff.MockTransport{Scheme: "a", SecureLvl: 0},
+	}
+	manager := NewConnManagerWithTransports(
+		context.Background(),
+		nil,
+		nil,
+		NewDeduplicationManager(false, nil),
+		nil,
+		transports,
+	)
+	metrics := NewMetrics(manager)
+	key := hex.EncodeToString(debugstuff.MockPubKey())
+	uri, _ := url.Parse("a://host:123?mock_peer_key=" + key)
+	conn, err := manager.Connect(*uri)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer conn.Close()
+	header := make([]byte, 6+32)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("Error while reading from conn: %s", err)
+	}
+	// Duplicate is rejected by deduplicator
+	duplicate, err := manager.Connect(*uri)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	waitDone(t, duplicate)
+	// Wrong transport key
+	query := uri.Query()
+	query.Set("mock_transport_key", hex.EncodeToString(make([]byte, 32)))
+	uri.RawQuery = query.Encode()
+	wrong, err := manager.Connect(*uri)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	waitDone(t, wrong)
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("Wrong content type %s", recorder.Header().Get("Content-Type"))
+	}
+	output := recorder.Body.String()
+	for _, line := range []string{
+		"# TYPE ytl_active_connections gauge",
+		`ytl_active_connections{scheme="a"} 1`,
+		"ytl_handshake_successes_total 1",
+		`ytl_handshake_failures_total{error="ConnClosedByDeduplicatorError"} 1`,
+		`ytl_handshake_failures_total{error="TransportSecurityCheckError"} 1`,
+		"ytl_dedup_evictions_total 0",
+		"ytl_bytes_read_total 38",
+		`ytl_dial_duration_seconds_bucket{scheme="a",le="+Inf"} 3`,
+		`ytl_dial_duration_seconds_count{scheme="a"} 3`,
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("Metrics do not contain %q:\n%s", line, output)
+		}
+	}
+}
+
+func TestMetricsDedupEviction(t *testing.T) {
+	transports := []static.Transport{
+		debugstuff.MockTransport{Scheme: "a", SecureLvl: 0},
+		debugstuff.MockTransport{Scheme: "b", SecureLvl: 1},
+	}
+	manager := NewConnManagerWithTransports(
+		context.Background(),
+		nil,
+		nil,
+		NewDeduplicationManager(true, nil),
+		nil,
+		transports,
+	)
+	defer manager.Close()
+	metrics := NewMetrics(manager)
+	key := hex.EncodeToString(debugstuff.MockPubKey())
+	insecure, _ := url.Parse("a://host:123?mock_peer_key=" + key)
+	secure, _ := url.Parse("b://host:123?mock_peer_key=" + key)
+	conn, err := manager.Connect(*insecure)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := conn.Handshake(context.Background()); err != nil {
+		t.Fatalf("Unexpected handshake error: %s", err)
+	}
+	// Less secure duplicate is rejected and not counted
+	duplicate, err := manager.Connect(*insecure)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	waitDone(t, duplicate)
+	// More secure duplicate evicts established connection
+	better, err := manager.Connect(*secure)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer better.Close()
+	if err := better.Handshake(context.Background()); err != nil {
+		t.Fatalf("Unexpected handshake error: %s", err)
+	}
+	waitDone(t, conn)
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	output := recorder.Body.String()
+	for _, line := range []string{
+		"ytl_handshake_successes_total 2",
+		`ytl_handshake_failures_total{error="ConnClosedByDeduplicatorError"} 1`,
+		"ytl_dedup_evictions_total 1",
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("Metrics do not contain %q:\n%s", line, output)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2022 DomesticMoth
+//
+// This file is part of Ytl.
+//
+// Ytl is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 3 of the License, or (at your option) any later version.
+//
+// Ytl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program; if not, write to the Free Software Foundation,
+// Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package ytl
+
+import (
+	"crypto/ed25519"
+	"github.com/DomesticMoth/ytl/static"
+	"net"
+	"net/url"
+	"time"
+)
+
+// Describes connection at the moment of event.
+type ConnEvent struct {
+	// Connected uri for outbound connections
+	// or listened uri for inbound ones
+	Uri        url.URL
+	RemoteAddr net.Addr
+	// Key of connected node (nil until handshake package is received)
+	PublicKey ed25519.PublicKey
+	// Protocol version (nil until handshake package is received)
+	Version       *static.ProtoVersion
+	SecurityLevel uint
+	Direction     ConnDirection
+	// Time spent for dialing in OnDial
+	// or time since transport connection was established in other events
+	Duration time.Duration
+	// Traffic of connection at the moment of event
+	BytesRead    uint64
+	BytesWritten uint64
+	// Error that caused event if any.
+	// It is one of static error types or transport error.
+	Err error
+}
+
+// Receives connection lifecycle events from ConnManager.
+//
+// Methods are called synchronously from connection goroutines,
+// so they must not block.
+type ConnObserver interface {
+	// Called after outbound connection attempt.
+	// Err is not nil if transport failed to connect.
+	OnDial(event ConnEvent)
+	// Called when listener accepts new transport connection
+	OnAccept(event ConnEvent)
+	// Called when handshake package is received
+	// and all checks are passed
+	OnHandshake(event ConnEvent)
+	// Called when connection is rejected because of
+	// wrong transport key, allow list, deduplication,
+	// invalid handshake or ygg-over-ygg address.
+	OnReject(event ConnEvent, reason error)
+	// Called once when connection is closed.
+	// Err holds the reason of closing if any.
+	OnClose(event ConnEvent)
+}
+
+// ConnObserver that ignores all events.
+// It can be embedded to implement only part of methods.
+type NopObserver struct{}
+
+func (NopObserver) OnDial(ConnEvent) {}
+
+func (NopObserver) OnAccept(ConnEvent) {}
+
+func (NopObserver) OnHandshake(ConnEvent) {}
+
+func (NopObserver) OnReject(ConnEvent, error) {}
+
+func (NopObserver) OnClose(ConnEvent) {}
+
+// Dispatches events to set of observers.
+// It is safe for concurrent use.
+type observerList struct {
+	lockChan  chan struct{}
+	observers []ConnObserver
+}
+
+func newObserverList() *observerList {
+	lock := make(chan struct{}, 1)
+	lock <- struct{}{}
+	return &observerList{lock, nil}
+}
+
+func (l *observerList) Add(observer ConnObserver) {
+	<-l.lockChan
+	defer func() { l.lockChan <- struct{}{} }()
+	observers := make([]ConnObserver, len(l.observers), len(l.observers)+1)
+	copy(observers, l.observers)
+	l.observers = append(observers, observer)
+}
+
+func (l *observerList) get() []ConnObserver {
+	<-l.lockChan
+	defer func() { l.lockChan <- struct{}{} }()
+	return l.observers
+}
+
+func (l *observerList) OnDial(event ConnEvent) {
+	for _, o := range l.get() {
+		o.OnDial(event)
+	}
+}
+
+func (l *observerList) OnAccept(event ConnEvent) {
+	for _, o := range l.get() {
+		o.OnAccept(event)
+	}
+}
+
+func (l *observerList) OnHandshake(event ConnEvent) {
+	for _, o := range l.get() {
+		o.OnHandshake(event)
+	}
+}
+
+func (l *observerList) OnReject(event ConnEvent, reason error) {
+	for _, o := range l.get() {
+		o.OnReject(event, reason)
+	}
+}
+
+func (l *observerList) OnClose(event ConnEvent) {
+	for _, o := range l.get() {
+		o.OnClose(event)
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright 2022 DomesticMoth
+//
+// This file is part of Ytl.
+//
+// Ytl is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 3 of the License, or (at your option) any later version.
+//
+// Ytl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program; if not, write to the Free Software Foundation,
+// Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package ytl
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"github.com/DomesticMoth/ytl/debugstuff"
+	"github.com/DomesticMoth/ytl/static"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type recordedEvent struct {
+	name  string
+	event ConnEvent
+}
+
+type recordingObserver struct {
+	events chan recordedEvent
+}
+
+func (o recordingObserver) OnDial(event ConnEvent) {
+	o.events <- recordedEvent{"dial", event}
+}
+
+func (o recordingObserver) OnAccept(event ConnEvent) {
+	o.events <- recordedEvent{"accept", event}
+}
+
+func (o recordingObserver) OnHandshake(event ConnEvent) {
+	o.events <- recordedEvent{"handshake", event}
+}
+
+func (o recordingObserver) OnReject(event ConnEvent, reason error) {
+	event.Err = reason
+	o.events <- recordedEvent{"reject", event}
+}
+
+func (o recordingObserver) OnClose(event ConnEvent) {
+	o.events <- recordedEvent{"close", event}
+}
+
+func (o recordingObserver) expect(t *testing.T, name string) ConnEvent {
+	select {
+	case e := <-o.events:
+		if e.name != name {
+			t.Fatalf("Unexpected event %s instead of %s", e.name, name)
+		}
+		return e.event
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Event %s was not received", name)
+	}
+	return ConnEvent{}
+}
+
+func TestConnManagerObserver(t *testing.T) {
+	transports := []static.Transport{
+		debugstuff.MockTransport{Scheme: "a", SecureLvl: 1},
+	}
+	manager := NewConnManagerWithTransports(
+		context.Background(),
+		nil,
+		nil,
+		nil,
+		nil,
+		transports,
+	)
+	observer := recordingObserver{make(chan recordedEvent, 16)}
+	manager.AddObserver(observer)
+	key := debugstuff.MockPubKey()
+	uri, _ := url.Parse("a://host:123?mock_peer_key=" + hex.EncodeToString(key))
+	// Successful outbound connection
+	conn, err := manager.Connect(*uri)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	event := observer.expect(t, "dial")
+	if event.Err != nil || event.Direction != DIRECTION_OUTBOUND || event.SecurityLevel != 1 {
+		t.Errorf("Wrong dial event %v", event)
+	}
+	event = observer.expect(t, "handshake")
+	if bytes.Compare(event.PublicKey, key) != 0 {
+		t.Errorf("Wrong key in handshake event")
+	}
+	if event.Version == nil || *event.Version != static.PROTO_VERSION() {
+		t.Errorf("Wrong version in handshake event")
+	}
+	conn.Close()
+	event = observer.expect(t, "close")
+	if event.Uri.String() != uri.String() {
+		t.Errorf("Wrong uri in close event %s", event.Uri.String())
+	}
+	// Inbound connection
+	listener, err := manager.Listen(*uri)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	conn, err = listener.Accept()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	event = observer.expect(t, "accept")
+	if event.Direction != DIRECTION_INBOUND {
+		t.Errorf("Wrong direction in accept event")
+	}
+	event = observer.expect(t, "handshake")
+	if event.Direction != DIRECTION_INBOUND {
+		t.Errorf("Wrong direction in handshake event")
+	}
+	conn.Close()
+	observer.expect(t, "close")
+	// Connection rejected by transport key check
+	query := uri.Query()
+	query.Set("mock_transport_key", hex.EncodeToString(make([]byte, len(key))))
+	uri.RawQuery = query.Encode()
+	conn, err = manager.Connect(*uri)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer conn.Close()
+	observer.expect(t, "dial")
+	event = observer.expect(t, "reject")
+	switch event.Err.(type) {
+	case static.TransportSecurityCheckError:
+		// Ok
+	default:
+		t.Errorf("Wrong reject reason %s", event.Err)
+	}
+	if bytes.Compare(event.PublicKey, key) != 0 {
+		t.Errorf("Wrong key in reject event")
+	}
+	event = observer.expect(t, "close")
+	switch event.Err.(type) {
+	case static.TransportSecurityCheckError:
+		// Ok
+	default:
+		t.Errorf("Wrong close reason %s", event.Err)
+	}
+}
+
+type rejectObserver struct {
+	NopObserver
+	reasons chan error
+}
+
+func (o rejectObserver) OnReject(event ConnEvent, reason error) {
+	o.reasons <- reason
+}
+
+func TestConnManagerObserverTransportReject(t *testing.T) {
+	transports := []static.Transport{
+		debugstuff.MockTransport{Scheme: "a", SecureLvl: 1},
+	}
+	allowList := static.AllowList{debugstuff.MockPubKey()}
+	manager := NewConnManagerWithTransports(
+		context.Background(),
+		nil,
+		nil,
+		nil,
+		&allowList,
+		transports,
+	)
+	observer := rejectObserver{reasons: make(chan error, 1)}
+	manager.AddObserver(observer)
+	uri, _ := url.Parse(
+		"a://host:123?mock_transport_key=" + hex.EncodeToString(make([]byte, 32)),
+	)
+	if _, err := manager.Connect(*uri); err == nil {
+		t.Fatalf("Key that is not in allow list should cause an error")
+	}
+	select {
+	case reason := <-observer.reasons:
+		switch reason.(type) {
+		case static.IvalidPeerPublicKey:
+			// Ok
+		default:
+			t.Errorf("Wrong reject reason %s", reason)
+		}
+	default:
+		t.Errorf("Reject event was not received")
+	}
+}
+
+type reentrantObserver struct {
+	NopObserver
+	conns  chan *YggConn
+	closed chan struct{}
+}
+
+func (o reentrantObserver) OnClose(event ConnEvent) {
+	// Closing connection again from observer must not deadlock
+	(<-o.conns).Close()
+	close(o.closed)
+}
+
+func TestConnManagerObserverReentrantClose(t *testing.T) {
+	transports := []static.Transport{
+		debugstuff.MockTransport{Scheme: "a", SecureLvl: 0},
+	}
+	manager := NewConnManagerWithTransports(
+		context.Background(),
+		nil,
+		nil,
+		nil,
+		nil,
+		transports,
+	)
+	defer manager.Close()
+	observer := reentrantObserver{
+		conns:  make(chan *YggConn, 1),
+		closed: make(chan struct{}),
+	}
+	manager.AddObserver(observer)
+	uri, _ := url.Parse("a://host:123")
+	conn, err := manager.Connect(*uri)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	observer.conns <- conn
+	go conn.Close()
+	select {
+	case <-observer.closed:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Close deadlocked in observer")
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2022 DomesticMoth
+//
+// This file is part of Ytl.
+//
+// Ytl is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 3 of the License, or (at your option) any later version.
+//
+// Ytl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program; if not, write to the Free Software Foundation,
+// Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package ytl
+
+import (
+	"context"
+	"github.com/DomesticMoth/ytl/static"
+	"math/rand"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Default reconnection delays of PeerSupervisor
+const (
+	DEFAULT_MIN_BACKOFF = time.Second
+	DEFAULT_MAX_BACKOFF = 5 * time.Minute
+)
+
+// PeerSupervisor keeps live connection to each of passed peers.
+//
+// When connection to peer fails or is closed,
+// it will be reopened after exponentially growing delay with jitter.
+// Delay is reset after each successful handshake.
+//
+// If connection was closed by DeduplicationManager,
+// peer is already connected in other way,
+// so next try is delayed by MaxBackoff.
+type PeerSupervisor struct {
+	// Min delay before reconnection
+	MinBackoff time.Duration
+	// Max delay before reconnection
+	MaxBackoff time.Duration
+	manager    *ConnManager
+	peers      []url.URL
+	onConnect  func(uri url.URL, conn *YggConn)
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+// Creates new PeerSupervisor that opens connections via manager.
+//
+// onConnect callback is called for each new connection
+// from the goroutine serving its peer.
+// Supervisor waits for the connection to be closed after callback returns,
+// so callback (or code it passes connection to)
+// must close connection when it is no longer needed.
+func NewPeerSupervisor(
+	manager *ConnManager,
+	peers []url.URL,
+	onConnect func(uri url.URL, conn *YggConn),
+) *PeerSupervisor {
+	ctx, cancel := context.WithCancel(manager.ctx)
+	if onConnect == nil {
+		onConnect = func(url.URL, *YggConn) {}
+	}
+	return &PeerSupervisor{
+		MinBackoff: DEFAULT_MIN_BACKOFF,
+		MaxBackoff: DEFAULT_MAX_BACKOFF,
+		manager:    manager,
+		peers:      append([]url.URL{}, peers...),
+		onConnect:  onConnect,
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// Starts supervising all peers.
+func (s *PeerSupervisor) Start() {
+	for _, peer := range s.peers {
+		s.wg.Add(1)
+		go s.supervise(peer)
+	}
+}
+
+// Stops supervising, closes all supervised connections
+// and waits for all goroutines to finish.
+//
+// Supervisor is also stopped when ConnManager context is done.
+func (s *PeerSupervisor) Stop() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+// Returns delay in [delay/2, delay) range
+func withJitter(delay time.Duration) time.Duration {
+	if delay < 2 {
+		return delay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
+
+func (s *PeerSupervisor) supervise(uri url.URL) {
+	defer s.wg.Done()
+	backoff := s.MinBackoff
+	for {
+		delay := backoff
+		conn, err := s.manager.ConnectCtx(s.ctx, uri)
+		if err == nil {
+			// Connections rejected by handshake checks are not published
+			if err = conn.Handshake(s.ctx); err != nil {
+				conn.Close()
+			}
+		}
+		if err == nil {
+			backoff = s.MinBackoff
+			delay = backoff
+			s.onConnect(uri, conn)
+			select {
+			case <-conn.Done():
+			case <-s.ctx.Done():
+				conn.Close()
+				return
+			}
+			err = conn.getErr()
+		}
+		if _, ok := err.(static.ConnClosedByDeduplicatorError); ok {
+			// Peer is already connected
+			delay = s.MaxBackoff
+		}
+		if backoff *= 2; backoff > s.MaxBackoff {
+			backoff = s.MaxBackoff
+		}
+		select {
+		case <-time.After(withJitter(delay)):
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
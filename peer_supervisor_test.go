@@ -0,0 +1,125 @@
+// Copyright 2022 DomesticMoth
+//
+// This file is part of Ytl.
+//
+// Ytl is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 3 of the License, or (at your option) any later version.
+//
+// Ytl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program; if not, write to the Free Software Foundation,
+// Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package ytl
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"github.com/DomesticMoth/ytl/debugstuff"
+	"github.com/DomesticMoth/ytl/static"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPeerSupervisorReconnect(t *testing.T) {
+	transports := []static.Transport{
+		debugstuff.MockTransport{Scheme: "a", SecureLvl: 0},
+	}
+	manager := NewConnManagerWithTransports(
+		context.Background(),
+		nil,
+		nil,
+		nil,
+		nil,
+		transports,
+	)
+	uri, _ := url.Parse("a://host:123")
+	var count int32
+	supervisor := NewPeerSupervisor(manager, []url.URL{*uri}, func(u url.URL, conn *YggConn) {
+		atomic.AddInt32(&count, 1)
+		conn.Close()
+	})
+	supervisor.MinBackoff = time.Millisecond * 10
+	supervisor.MaxBackoff = time.Millisecond * 20
+	supervisor.Start()
+	time.Sleep(time.Millisecond * 300)
+	supervisor.Stop()
+	if atomic.LoadInt32(&count) < 3 {
+		t.Errorf("Connection was reopened only %d times", count)
+	}
+}
+
+func TestPeerSupervisorDeduplication(t *testing.T) {
+	transports := []static.Transport{
+		debugstuff.MockTransport{Scheme: "a", SecureLvl: 0},
+	}
+	manager := NewConnManagerWithTransports(
+		context.Background(),
+		nil,
+		nil,
+		NewDeduplicationManager(false, nil),
+		nil,
+		transports,
+	)
+	key := hex.EncodeToString(debugstuff.MockPubKey())
+	uri1, _ := url.Parse("a://host1:123?mock_peer_key=" + key)
+	uri2, _ := url.Parse("a://host2:123?mock_peer_key=" + key)
+	var count int32
+	supervisor := NewPeerSupervisor(manager, []url.URL{*uri1, *uri2}, func(u url.URL, conn *YggConn) {
+		atomic.AddInt32(&count, 1)
+	})
+	supervisor.MinBackoff = time.Millisecond * 10
+	supervisor.MaxBackoff = time.Minute
+	supervisor.Start()
+	time.Sleep(time.Millisecond * 300)
+	supervisor.Stop()
+	// Only one peer is connected, deduplicated peer must wait MaxBackoff
+	if atomic.LoadInt32(&count) != 1 {
+		t.Errorf("Connections were opened %d times", count)
+	}
+}
+
+func TestPeerSupervisorRejectedHandshake(t *testing.T) {
+	transports := []static.Transport{
+		debugstuff.MockTransport{Scheme: "a", SecureLvl: 0},
+	}
+	other, _, _ := ed25519.GenerateKey(nil)
+	allowList := static.AllowList{other}
+	manager := NewConnManagerWithTransports(
+		context.Background(),
+		nil,
+		nil,
+		nil,
+		&allowList,
+		transports,
+	)
+	observer := rejectObserver{reasons: make(chan error, 100)}
+	manager.AddObserver(observer)
+	uri, _ := url.Parse("a://host:123")
+	var count int32
+	supervisor := NewPeerSupervisor(manager, []url.URL{*uri}, func(u url.URL, conn *YggConn) {
+		atomic.AddInt32(&count, 1)
+	})
+	supervisor.MinBackoff = time.Millisecond * 10
+	supervisor.MaxBackoff = time.Minute
+	supervisor.Start()
+	time.Sleep(time.Millisecond * 300)
+	supervisor.Stop()
+	if atomic.LoadInt32(&count) != 0 {
+		t.Errorf("Rejected connection was published")
+	}
+	// Delay grows as 10ms, 20ms, 40ms... with jitter,
+	// it would be reset by rejected handshakes otherwise
+	if tries := len(observer.reasons); tries == 0 || tries > 8 {
+		t.Errorf("Connection was opened %d times", tries)
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2022 DomesticMoth
+//
+// This file is part of Ytl.
+//
+// Ytl is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 3 of the License, or (at your option) any later version.
+//
+// Ytl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program; if not, write to the Free Software Foundation,
+// Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package ytl
+
+import (
+	"context"
+	"github.com/DomesticMoth/ytl/dialers"
+	"net/url"
+	"time"
+)
+
+// Default backoff of unhealthy proxies.
+// Backoff is doubled after every consecutive failure
+// until max backoff is reached.
+const (
+	DEFAULT_PROXY_BACKOFF     = 5 * time.Second
+	DEFAULT_PROXY_MAX_BACKOFF = 5 * time.Minute
+)
+
+// Default interval of proxy health probes
+const DEFAULT_PROXY_PROBE_INTERVAL = 30 * time.Second
+
+// ProxyHealth is a snapshot of proxy health state.
+type ProxyHealth struct {
+	Proxy *url.URL
+	// False if proxy failed and its backoff is not over yet
+	Healthy bool
+	// Count of consecutive failures
+	Failures int
+	// Time after which unhealthy proxy is tried first again
+	RetryAt time.Time
+	// Error of last failure (nil if last check succeeded)
+	LastError error
+	// Time of last success or failure (zero if proxy was not used yet)
+	LastCheck time.Time
+}
+
+// Checks whether proxy is reachable
+type ProxyProbe func(ctx context.Context, proxy *url.URL) error
+
+// Checks that tcp connection with proxy can be established
+// with default TcpDialer.
+func TcpProxyProbe(ctx context.Context, proxy *url.URL) error {
+	return NewTcpProxyProbe(dialers.TcpDialer{})(ctx, proxy)
+}
+
+// Returns probe that connects to proxy with dialer,
+// so proxy address is checked and dialer Control is applied
+// in the same way as for the first proxy of chain.
+func NewTcpProxyProbe(dialer dialers.TcpDialer) ProxyProbe {
+	return func(ctx context.Context, proxy *url.URL) error {
+		return dialer.ProbeProxy(ctx, proxy)
+	}
+}
+
+// Stores health states of proxies.
+//
+// It is safe for concurrent use.
+type proxyHealth struct {
+	lockChan   chan struct{}
+	states     map[string]*ProxyHealth
+	proxies    []string
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+func newProxyHealth(proxies []*url.URL) *proxyHealth {
+	lock := make(chan struct{}, 1)
+	lock <- struct{}{}
+	h := &proxyHealth{
+		lock,
+		make(map[string]*ProxyHealth),
+		make([]string, 0, len(proxies)),
+		DEFAULT_PROXY_BACKOFF,
+		DEFAULT_PROXY_MAX_BACKOFF,
+	}
+	for _, proxy := range proxies {
+		if proxy != nil {
+			h.state(proxy)
+		}
+	}
+	return h
+}
+
+func (h *proxyHealth) lock() {
+	<-h.lockChan
+}
+
+func (h *proxyHealth) unlock() {
+	h.lockChan <- struct{}{}
+}
+
+// Returns state of proxy creating it if needed.
+// Lock must be held or object must not be shared yet.
+func (h *proxyHealth) state(proxy *url.URL) *ProxyHealth {
+	key := proxy.String()
+	state, ok := h.states[key]
+	if !ok {
+		state = &ProxyHealth{Proxy: proxy, Healthy: true}
+		h.states[key] = state
+		h.proxies = append(h.proxies, key)
+	}
+	return state
+}
+
+// Returns chains with healthy first proxy followed by other ones.
+// Order of chains is kept inside both groups.
+func (h *proxyHealth) order(chains [][]*url.URL) [][]*url.URL {
+	if h == nil || len(chains) < 2 {
+		return chains
+	}
+	now := time.Now()
+	healthy := make([][]*url.URL, 0, len(chains))
+	unhealthy := make([][]*url.URL, 0)
+	h.lock()
+	for _, chain := range chains {
+		if len(chain) > 0 && !h.state(chain[0]).isHealthy(now) {
+			unhealthy = append(unhealthy, chain)
+		} else {
+			healthy = append(healthy, chain)
+		}
+	}
+	h.unlock()
+	return append(healthy, unhealthy...)
+}
+
+func (s *ProxyHealth) isHealthy(now time.Time) bool {
+	return s.Failures == 0 || !now.Before(s.RetryAt)
+}
+
+// Records success (if err is nil) or failure of proxy
+func (h *proxyHealth) report(proxy *url.URL, err error) {
+	if h == nil || proxy == nil {
+		return
+	}
+	h.lock()
+	defer h.unlock()
+	state := h.state(proxy)
+	state.LastCheck = time.Now()
+	state.LastError = err
+	if err == nil {
+		state.Failures = 0
+		state.RetryAt = time.Time{}
+		return
+	}
+	backoff := h.backoff
+	for i := 0; i < state.Failures && backoff < h.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > h.maxBackoff {
+		backoff = h.maxBackoff
+	}
+	state.Failures += 1
+	state.RetryAt = state.LastCheck.Add(backoff)
+}
+
+// Returns copies of all states in order proxies were added
+func (h *proxyHealth) snapshot() []ProxyHealth {
+	if h == nil {
+		return []ProxyHealth{}
+	}
+	now := time.Now()
+	h.lock()
+	defer h.unlock()
+	ret := make([]ProxyHealth, len(h.proxies))
+	for i, key := range h.proxies {
+		ret[i] = *h.states[key]
+		ret[i].Healthy = h.states[key].isHealthy(now)
+	}
+	return ret
+}
+
+// Sets backoff of unhealthy proxies.
+// Non positive values are replaced with defaults.
+//
+// It must be called before using ProxyManager.
+func (p *ProxyManager) SetBackoff(backoff time.Duration, maxBackoff time.Duration) {
+	if p.health == nil {
+		return
+	}
+	if backoff <= 0 {
+		backoff = DEFAULT_PROXY_BACKOFF
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = DEFAULT_PROXY_MAX_BACKOFF
+	}
+	p.health.lock()
+	defer p.health.unlock()
+	p.health.backoff = backoff
+	p.health.maxBackoff = maxBackoff
+}
+
+// Records result of connecting to proxy.
+// Nil err marks proxy healthy, otherwise
+// proxy is marked unhealthy until its backoff is over.
+//
+// ConnManager reports results of connections by itself.
+func (p *ProxyManager) Report(proxy *url.URL, err error) {
+	p.health.report(proxy, err)
+}
+
+// Returns health of all known proxies.
+func (p *ProxyManager) Health() []ProxyHealth {
+	return p.health.snapshot()
+}
+
+// Starts goroutine that checks all known proxies with probe every interval.
+// If probe is nil, TcpProxyProbe is used.
+// If interval is not positive, DEFAULT_PROXY_PROBE_INTERVAL is used.
+// Every check is limited by interval.
+//
+// Probing stops when ctx is done.
+func (p *ProxyManager) StartHealthProbes(ctx context.Context, interval time.Duration, probe ProxyProbe) {
+	if interval <= 0 {
+		interval = DEFAULT_PROXY_PROBE_INTERVAL
+	}
+	if probe == nil {
+		probe = TcpProxyProbe
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			for _, state := range p.Health() {
+				probeCtx, cancel := context.WithTimeout(ctx, interval)
+				err := probe(probeCtx, state.Proxy)
+				cancel()
+				if ctx.Err() != nil {
+					return
+				}
+				p.Report(state.Proxy, err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
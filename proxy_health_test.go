@@ -0,0 +1,158 @@
+// Copyright 2022 DomesticMoth
+//
+// This file is part of Ytl.
+//
+// Ytl is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 3 of the License, or (at your option) any later version.
+//
+// Ytl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program; if not, write to the Free Software Foundation,
+// Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package ytl
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"github.com/DomesticMoth/ytl/debugstuff"
+	"github.com/DomesticMoth/ytl/static"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestProxyManagerHealth(t *testing.T) {
+	first, _ := url.Parse("socks://first")
+	second, _ := url.Parse("socks://second")
+	tor, _ := url.Parse("socks://tor")
+	manager := NewProxyManager(nil, []ProxyMapping{
+		{
+			HostRegexp: *regexp.MustCompile(`\.onion$`),
+			Proxy:      first,
+			Fallback:   []*url.URL{second},
+			Chain:      []*url.URL{tor},
+		},
+	})
+	manager.SetBackoff(time.Millisecond*100, time.Millisecond*300)
+	uri, _ := url.Parse("tcp://node.onion")
+	chains := manager.GetChains(*uri)
+	if len(chains) != 2 || chains[0][0] != first || chains[1][0] != second || chains[1][1] != tor {
+		t.Fatalf("Wrong chains %v", chains)
+	}
+	manager.Report(first, errors.New("down"))
+	if chain := manager.GetChain(*uri); chain[0] != second {
+		t.Errorf("Unhealthy proxy was not moved to the end")
+	}
+	health := manager.Health()
+	// Next hops of chain are not tracked, so they are never probed directly
+	if len(health) != 2 || health[0].Proxy != first || health[0].Healthy || health[0].Failures != 1 {
+		t.Errorf("Wrong health %+v", health)
+	}
+	for _, h := range health {
+		if h.Proxy == tor {
+			t.Errorf("Next hop of chain is tracked")
+		}
+	}
+	if backoff := health[0].RetryAt.Sub(health[0].LastCheck); backoff != time.Millisecond*100 {
+		t.Errorf("Wrong backoff %s", backoff)
+	}
+	manager.Report(first, errors.New("down"))
+	manager.Report(first, errors.New("down"))
+	health = manager.Health()
+	if backoff := health[0].RetryAt.Sub(health[0].LastCheck); backoff != time.Millisecond*300 {
+		t.Errorf("Backoff must be limited, got %s", backoff)
+	}
+	time.Sleep(time.Millisecond * 350)
+	if chain := manager.GetChain(*uri); chain[0] != first {
+		t.Errorf("Proxy was not retried after backoff")
+	}
+	manager.Report(first, nil)
+	if health := manager.Health(); !health[0].Healthy || health[0].Failures != 0 || health[0].LastError != nil {
+		t.Errorf("Success must reset health %+v", health[0])
+	}
+}
+
+func TestProxyManagerHealthProbes(t *testing.T) {
+	good, _ := url.Parse("socks://good")
+	bad, _ := url.Parse("socks://bad")
+	manager := NewProxyManager(good, []ProxyMapping{{Proxy: bad}})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	manager.StartHealthProbes(ctx, time.Millisecond*10, func(ctx context.Context, proxy *url.URL) error {
+		if proxy.Host == "bad" {
+			return errors.New("down")
+		}
+		return nil
+	})
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		health := manager.Health()
+		if !health[0].LastCheck.IsZero() && !health[1].LastCheck.IsZero() {
+			if !health[0].Healthy || health[1].Healthy {
+				t.Errorf("Wrong health %+v", health)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Proxies were not probed")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// Mock transport which proxies with host "down" are unreachable
+type failoverTransport struct {
+	debugstuff.MockTransport
+	proxies chan string
+}
+
+func (t failoverTransport) Connect(ctx context.Context, uri url.URL, proxy *url.URL, key ed25519.PrivateKey) (static.ConnResult, error) {
+	t.proxies <- proxy.Host
+	if proxy.Host == "down" {
+		return static.ConnResult{}, static.ProxyError{Proxy: proxy.String(), Err: errors.New("refused")}
+	}
+	return t.MockTransport.Connect(ctx, uri, proxy, key)
+}
+
+func TestConnManagerProxyFailover(t *testing.T) {
+	down, _ := url.Parse("socks://down")
+	up, _ := url.Parse("socks://up")
+	proxy := NewProxyManager(nil, []ProxyMapping{{Proxy: down, Fallback: []*url.URL{up}}})
+	transport := failoverTransport{debugstuff.MockTransport{Scheme: "a"}, make(chan string, 4)}
+	manager := NewConnManagerWithTransports(
+		context.Background(),
+		nil,
+		&proxy,
+		nil,
+		nil,
+		[]static.Transport{transport},
+	)
+	uri, _ := url.Parse("a://host:123")
+	for i, expected := range [][]string{{"down", "up"}, {"up"}} {
+		conn, err := manager.Connect(*uri)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		conn.Close()
+		for _, host := range expected {
+			if used := <-transport.proxies; used != host {
+				t.Errorf("Attempt %d used proxy %s instead of %s", i, used, host)
+			}
+		}
+		if len(transport.proxies) != 0 {
+			t.Errorf("Attempt %d used extra proxies", i)
+		}
+	}
+	if health := proxy.Health(); health[0].Healthy || !health[1].Healthy {
+		t.Errorf("Wrong health %+v", health)
+	}
+}
@@ -19,18 +19,255 @@
 package ytl
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"github.com/DomesticMoth/ytl/static"
+	"github.com/DomesticMoth/ytl/transports"
+	"net"
 	"net/url"
+	"os"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 )
 
+// Inclusive range of ports
+type PortRange struct {
+	From uint16
+	To   uint16
+}
+
+// Checks whether port is in range
+func (r PortRange) Contains(port uint16) bool {
+	return port >= r.From && port <= r.To
+}
+
 // ProxyMapping is a representation of the correspondence
 // between hosts that fall under the regular expression
 // and proxy that should be used to connect to these hosts.
+//
+// All set conditions must match for mapping to be applied.
+// Mapping without conditions matches any uri.
 type ProxyMapping struct {
-	// RegExp for host matching
+	// RegExp for host matching (host includes port if it is set).
+	// Empty RegExp matches any host.
 	HostRegexp regexp.Regexp
 	// Proxy (may be nil)
 	Proxy *url.URL
+	// Optional alternatives of Proxy in priority order.
+	// They are tried if Proxy or previous alternatives are unreachable.
+	Fallback []*url.URL
+	// Optional proxies that connection goes through after Proxy in order.
+	// The last one connects to the host.
+	// Transport must implement static.ProxyChainTransport to use it.
+	Chain []*url.URL
+	// Optional name of mapping used in explanations
+	Name string
+	// Transport schemes like "tcp" or "tls" (empty means any)
+	Schemes []string
+	// Hostname suffixes (empty means any).
+	// Suffix "example.com" matches "example.com" and "node.example.com".
+	HostSuffixes []string
+	// Port ranges (empty means any)
+	Ports []PortRange
+	// Networks of destination ip (empty means any).
+	// Hostnames are not resolved, so only uris
+	// with literal ip addresses can match.
+	Nets []*net.IPNet
+	// Peer keys from "key" uri param (empty means any)
+	Keys []ed25519.PublicKey
+	// Connect directly, bypassing default proxy
+	Direct bool
+	// Mappings with higher priority are checked first.
+	// Mappings with equal priority are checked in passed order.
+	Priority int
+}
+
+// Returns chains of proxies for Proxy and every Fallback in order.
+// Single nil chain means direct connection.
+func (m *ProxyMapping) chains() [][]*url.URL {
+	if m.Direct {
+		return [][]*url.URL{nil}
+	}
+	tail := make([]*url.URL, 0, len(m.Chain))
+	for _, proxy := range m.Chain {
+		if proxy != nil {
+			tail = append(tail, proxy)
+		}
+	}
+	chains := make([][]*url.URL, 0, len(m.Fallback)+1)
+	for _, first := range append([]*url.URL{m.Proxy}, m.Fallback...) {
+		if first != nil {
+			chains = append(chains, append([]*url.URL{first}, tail...))
+		}
+	}
+	if len(chains) == 0 {
+		if len(tail) == 0 {
+			return [][]*url.URL{nil}
+		}
+		chains = append(chains, tail)
+	}
+	return chains
+}
+
+// Checks case insensitive that hostname is equal to suffix
+// or is its subdomain without allocations.
+func hasHostSuffix(hostname string, suffix string) bool {
+	suffix = strings.TrimPrefix(suffix, ".")
+	if len(hostname) < len(suffix) || !strings.EqualFold(hostname[len(hostname)-len(suffix):], suffix) {
+		return false
+	}
+	return len(hostname) == len(suffix) || hostname[len(hostname)-len(suffix)-1] == '.'
+}
+
+// Returns hostname of uri without trailing dot
+func mappingHostname(uri url.URL) string {
+	return strings.TrimSuffix(uri.Hostname(), ".")
+}
+
+func (m *ProxyMapping) matchHost(uri url.URL) bool {
+	return m.HostRegexp.String() == "" || m.HostRegexp.MatchString(uri.Host)
+}
+
+func (m *ProxyMapping) matchScheme(uri url.URL) bool {
+	for _, scheme := range m.Schemes {
+		if strings.EqualFold(scheme, uri.Scheme) {
+			return true
+		}
+	}
+	return len(m.Schemes) == 0
+}
+
+func (m *ProxyMapping) matchSuffix(uri url.URL) bool {
+	hostname := mappingHostname(uri)
+	for _, suffix := range m.HostSuffixes {
+		if hasHostSuffix(hostname, suffix) {
+			return true
+		}
+	}
+	return len(m.HostSuffixes) == 0
+}
+
+func (m *ProxyMapping) matchPort(uri url.URL) bool {
+	if len(m.Ports) == 0 {
+		return true
+	}
+	port, err := strconv.ParseUint(uri.Port(), 10, 16)
+	if err != nil {
+		return false
+	}
+	for _, r := range m.Ports {
+		if r.Contains(uint16(port)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *ProxyMapping) matchNet(uri url.URL) bool {
+	if len(m.Nets) == 0 {
+		return true
+	}
+	ip := net.ParseIP(mappingHostname(uri))
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range m.Nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *ProxyMapping) matchKey(uri url.URL) bool {
+	if len(m.Keys) == 0 {
+		return true
+	}
+	for _, raw := range uri.Query()["key"] {
+		key, err := hex.DecodeString(raw)
+		if err != nil {
+			continue
+		}
+		for _, allowed := range m.Keys {
+			if bytes.Equal(allowed, key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Checks if mapping matches uri.
+// It is used on dial path, so it does not build texts of mismatches.
+// Only Nets and Keys conditions allocate if they are set.
+func (m *ProxyMapping) match(uri url.URL) bool {
+	return m.matchHost(uri) &&
+		m.matchScheme(uri) &&
+		m.matchSuffix(uri) &&
+		m.matchPort(uri) &&
+		m.matchNet(uri) &&
+		m.matchKey(uri)
+}
+
+// Returns empty string if mapping matches uri
+// or text with the first condition that does not match.
+// It is used by Explain only.
+func (m *ProxyMapping) mismatch(uri url.URL) string {
+	hostname := strings.ToLower(mappingHostname(uri))
+	switch {
+	case !m.matchHost(uri):
+		return "host does not match " + m.HostRegexp.String()
+	case !m.matchScheme(uri):
+		return "scheme " + uri.Scheme + " is not in " + strings.Join(m.Schemes, ",")
+	case !m.matchSuffix(uri):
+		return "hostname " + hostname + " has no suffix of " + strings.Join(m.HostSuffixes, ",")
+	case !m.matchPort(uri):
+		return fmt.Sprintf("port %q is not in ranges %v", uri.Port(), m.Ports)
+	case !m.matchNet(uri):
+		return "hostname " + hostname + " is not in networks"
+	case !m.matchKey(uri):
+		return "key param does not match"
+	}
+	return ""
+}
+
+// ProxyDecision explains which proxies are used for uri and why
+type ProxyDecision struct {
+	// Index of matched mapping in list passed to NewProxyManager
+	// or -1 if no mapping matched
+	Index int
+	// Matched mapping (nil if no mapping matched)
+	Mapping *ProxyMapping
+	// Proxies that connection goes through (nil for direct connection)
+	Chain []*url.URL
+	// All chains that are tried in order
+	// (the first one is Chain, healthy proxies go first)
+	Candidates [][]*url.URL
+	// Reasons why mappings with higher priority did not match
+	Skipped []string
+}
+
+func (d ProxyDecision) String() string {
+	via := "direct"
+	if len(d.Chain) > 0 {
+		proxies := make([]string, len(d.Chain))
+		for i, proxy := range d.Chain {
+			proxies[i] = proxy.Redacted()
+		}
+		via = strings.Join(proxies, " -> ")
+	}
+	if d.Mapping == nil {
+		return "no mapping matched, default: " + via
+	}
+	name := d.Mapping.Name
+	if name == "" {
+		name = fmt.Sprintf("#%d", d.Index)
+	}
+	return fmt.Sprintf("mapping %s matched: %s", name, via)
 }
 
 // Stores ProxyMappings and match
@@ -38,21 +275,191 @@ type ProxyMapping struct {
 type ProxyManager struct {
 	defaultProxy *url.URL
 	mapping      []ProxyMapping
+	// Indexes of mappings in passed list
+	indexes []int
+	// Shared by copies of ProxyManager
+	health *proxyHealth
 }
 
+// Mappings are sorted by priority,
+// mappings with equal priority keep passed order.
 func NewProxyManager(defaultProxy *url.URL, mapping []ProxyMapping) ProxyManager {
 	if mapping == nil {
 		mapping = make([]ProxyMapping, 0)
 	}
-	return ProxyManager{defaultProxy, mapping}
+	indexes := make([]int, len(mapping))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.SliceStable(indexes, func(i, j int) bool {
+		return mapping[indexes[i]].Priority > mapping[indexes[j]].Priority
+	})
+	sorted := make([]ProxyMapping, len(mapping))
+	for i, index := range indexes {
+		sorted[i] = mapping[index]
+	}
+	// Only first hops are tracked, because they are dialed directly.
+	// Probing next hops directly would reveal them to the network.
+	proxies := make([]*url.URL, 0)
+	if defaultProxy != nil {
+		proxies = append(proxies, defaultProxy)
+	}
+	for i := range sorted {
+		for _, chain := range sorted[i].chains() {
+			if len(chain) > 0 {
+				proxies = append(proxies, chain[0])
+			}
+		}
+	}
+	return ProxyManager{defaultProxy, sorted, indexes, newProxyHealth(proxies)}
+}
+
+// Builds ProxyManager from environment variables
+// in the same way as curl and other network tools do:
+//   - ALL_PROXY is used as default proxy
+//   - HTTPS_PROXY is used for tls and wss transports
+//   - http_proxy (only lowercase) is used for ws transport
+//   - NO_PROXY is comma separated list of hostnames,
+//     ip addresses and CIDRs that are connected directly.
+//     Hostname matches itself and its subdomains,
+//     single "*" disables proxies at all.
+//
+// Lowercase variables take precedence over uppercase ones.
+// Proxy without scheme is treated as http proxy.
+//
+// Passed mappings are checked before mappings built from environment
+// unless they have lower priority.
+func NewProxyManagerFromEnv(mapping []ProxyMapping) (ProxyManager, error) {
+	return NewProxyManagerWithEnv(os.Getenv, mapping)
+}
+
+// Same as NewProxyManagerFromEnv but reads variables with getenv.
+func NewProxyManagerWithEnv(getenv func(string) string, mapping []ProxyMapping) (ProxyManager, error) {
+	lookup := func(names ...string) (*url.URL, error) {
+		for _, name := range names {
+			raw := strings.TrimSpace(getenv(name))
+			if raw == "" {
+				continue
+			}
+			if !strings.Contains(raw, "://") {
+				raw = "http://" + raw
+			}
+			proxy, err := url.Parse(raw)
+			if err != nil || proxy.Host == "" {
+				return nil, static.InvalidUriError{Err: "invalid proxy in " + name}
+			}
+			return proxy, nil
+		}
+		return nil, nil
+	}
+	mappings := make([]ProxyMapping, 0, len(mapping)+4)
+	mappings = append(mappings, mapping...)
+	noProxy := getenv("no_proxy")
+	if noProxy == "" {
+		noProxy = getenv("NO_PROXY")
+	}
+	suffixes := make([]string, 0)
+	nets := make([]*net.IPNet, 0)
+	for _, entry := range strings.FieldsFunc(noProxy, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if entry == "*" {
+			mappings = append(mappings, ProxyMapping{Name: "NO_PROXY", Direct: true})
+			continue
+		}
+		if parsed, err := static.ParseCIDRs(strings.Trim(entry, "[]")); err == nil {
+			nets = append(nets, parsed...)
+			continue
+		}
+		suffixes = append(suffixes, entry)
+	}
+	if len(suffixes) > 0 {
+		mappings = append(mappings, ProxyMapping{Name: "NO_PROXY", HostSuffixes: suffixes, Direct: true})
+	}
+	if len(nets) > 0 {
+		mappings = append(mappings, ProxyMapping{Name: "NO_PROXY", Nets: nets, Direct: true})
+	}
+	httpsProxy, err := lookup("https_proxy", "HTTPS_PROXY")
+	if err != nil {
+		return ProxyManager{}, err
+	}
+	if httpsProxy != nil {
+		mappings = append(mappings, ProxyMapping{
+			Name:    "HTTPS_PROXY",
+			Schemes: []string{transports.TlsScheme, transports.WssScheme},
+			Proxy:   httpsProxy,
+		})
+	}
+	httpProxy, err := lookup("http_proxy")
+	if err != nil {
+		return ProxyManager{}, err
+	}
+	if httpProxy != nil {
+		mappings = append(mappings, ProxyMapping{
+			Name:    "http_proxy",
+			Schemes: []string{transports.WsScheme},
+			Proxy:   httpProxy,
+		})
+	}
+	allProxy, err := lookup("all_proxy", "ALL_PROXY")
+	if err != nil {
+		return ProxyManager{}, err
+	}
+	return NewProxyManager(allProxy, mappings), nil
+}
+
+// Returns decision about proxies for uri
+// with mapping that matched it.
+func (p *ProxyManager) Explain(uri url.URL) ProxyDecision {
+	skipped := make([]string, 0)
+	for i := range p.mapping {
+		mapping := &p.mapping[i]
+		reason := mapping.mismatch(uri)
+		if reason == "" {
+			chains := p.health.order(mapping.chains())
+			return ProxyDecision{p.indexes[i], mapping, chains[0], chains, skipped}
+		}
+		name := mapping.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", p.indexes[i])
+		}
+		skipped = append(skipped, name+": "+reason)
+	}
+	var chain []*url.URL = nil
+	if p.defaultProxy != nil {
+		chain = []*url.URL{p.defaultProxy}
+	}
+	return ProxyDecision{-1, nil, chain, [][]*url.URL{chain}, skipped}
 }
 
-// Retruns proxy matched to URI by it host
+// Retruns proxy matched to URI
+// (the first proxy of chain or nil for direct connection)
 func (p *ProxyManager) Get(uri url.URL) *url.URL {
-	for _, mapping := range p.mapping {
-		if mapping.HostRegexp.MatchString(uri.Host) {
-			return mapping.Proxy
+	chain := p.GetChain(uri)
+	if len(chain) == 0 {
+		return nil
+	}
+	return chain[0]
+}
+
+// Retruns chain of proxies matched to URI
+// or nil for direct connection.
+func (p *ProxyManager) GetChain(uri url.URL) []*url.URL {
+	return p.GetChains(uri)[0]
+}
+
+// Retruns all chains of proxies matched to URI
+// in order they should be tried.
+// Chains with unhealthy first proxy go last.
+// Nil chain means direct connection.
+//
+// Unlike Explain it does not collect reasons of mismatches.
+func (p *ProxyManager) GetChains(uri url.URL) [][]*url.URL {
+	for i := range p.mapping {
+		if p.mapping[i].match(uri) {
+			return p.health.order(p.mapping[i].chains())
 		}
 	}
-	return p.defaultProxy
+	if p.defaultProxy != nil {
+		return [][]*url.URL{{p.defaultProxy}}
+	}
+	return [][]*url.URL{nil}
 }
@@ -19,6 +19,9 @@
 package ytl
 
 import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"net"
 	"net/url"
 	"regexp"
 	"testing"
@@ -53,3 +56,164 @@ func TestProxyManager(t *testing.T) {
 		t.Errorf("Uri '%s' -> proxy '%s'", i2pUri, manager.Get(*i2pUri))
 	}
 }
+
+func TestProxyManagerChain(t *testing.T) {
+	corpProxy, _ := url.Parse("socks://corp")
+	torProxy, _ := url.Parse("socks://tor")
+	defaultProxy, _ := url.Parse("socks://default")
+	exampleUri, _ := url.Parse("tcp://exaple.com")
+	torUri, _ := url.Parse("tcp://exaple.onion")
+	directUri, _ := url.Parse("tcp://exaple.local")
+	mapping := []ProxyMapping{
+		{
+			HostRegexp: *regexp.MustCompile(`\.onion$`),
+			Proxy:      corpProxy,
+			Chain:      []*url.URL{torProxy},
+		},
+		{
+			HostRegexp: *regexp.MustCompile(`\.local$`),
+		},
+	}
+	manager := NewProxyManager(defaultProxy, mapping)
+	chain := manager.GetChain(*torUri)
+	if len(chain) != 2 || chain[0] != corpProxy || chain[1] != torProxy {
+		t.Errorf("Uri '%s' -> chain %v", torUri, chain)
+	}
+	if manager.Get(*torUri) != corpProxy {
+		t.Errorf("Uri '%s' -> proxy '%s'", torUri, manager.Get(*torUri))
+	}
+	chain = manager.GetChain(*exampleUri)
+	if len(chain) != 1 || chain[0] != defaultProxy {
+		t.Errorf("Uri '%s' -> chain %v", exampleUri, chain)
+	}
+	if chain = manager.GetChain(*directUri); chain != nil {
+		t.Errorf("Uri '%s' -> chain %v", directUri, chain)
+	}
+}
+
+func TestProxyManagerRules(t *testing.T) {
+	defaultProxy, _ := url.Parse("socks://default")
+	schemeProxy, _ := url.Parse("socks://scheme")
+	suffixProxy, _ := url.Parse("socks://suffix")
+	portProxy, _ := url.Parse("socks://port")
+	netProxy, _ := url.Parse("socks://net")
+	keyProxy, _ := url.Parse("socks://key")
+	key := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	key[0] = 1
+	_, lan, _ := net.ParseCIDR("10.0.0.0/8")
+	mapping := []ProxyMapping{
+		{Name: "scheme", Schemes: []string{"tls"}, Proxy: schemeProxy},
+		{Name: "suffix", HostSuffixes: []string{".example.com"}, Proxy: suffixProxy},
+		{Name: "port", Ports: []PortRange{{8000, 8999}}, Proxy: portProxy},
+		{Name: "net", Nets: []*net.IPNet{lan}, Proxy: netProxy},
+		{Name: "key", Keys: []ed25519.PublicKey{key}, Proxy: keyProxy},
+		{Name: "local", HostSuffixes: []string{"local"}, Direct: true},
+		// Has higher priority than "scheme"
+		{Name: "lan-tls", Schemes: []string{"tls"}, Nets: []*net.IPNet{lan}, Direct: true, Priority: 1},
+	}
+	manager := NewProxyManager(defaultProxy, mapping)
+	for _, test := range []struct {
+		uri   string
+		proxy *url.URL
+		name  string
+	}{
+		{"tls://host:1", schemeProxy, "scheme"},
+		{"tcp://example.com:1", suffixProxy, "suffix"},
+		{"tcp://node.Example.com:1", suffixProxy, "suffix"},
+		{"tcp://badexample.com:1", defaultProxy, ""},
+		{"tcp://host:8080", portProxy, "port"},
+		{"tcp://host:9000", defaultProxy, ""},
+		{"tcp://10.1.2.3:1", netProxy, "net"},
+		{"tcp://host:1?key=" + hex.EncodeToString(key), keyProxy, "key"},
+		{"tcp://node.local:1", nil, "local"},
+		{"tls://10.1.2.3:1", nil, "lan-tls"},
+	} {
+		uri, _ := url.Parse(test.uri)
+		decision := manager.Explain(*uri)
+		if manager.Get(*uri) != test.proxy {
+			t.Errorf("Uri '%s' -> proxy '%s' (%s)", test.uri, manager.Get(*uri), decision)
+		}
+		name := ""
+		if decision.Mapping != nil {
+			name = decision.Mapping.Name
+			if mapping[decision.Index].Name != name {
+				t.Errorf("Wrong index %d for %s", decision.Index, name)
+			}
+		}
+		if name != test.name {
+			t.Errorf("Uri '%s' matched '%s' instead of '%s'", test.uri, name, test.name)
+		}
+	}
+	uri, _ := url.Parse("tcp://host:9000")
+	decision := manager.Explain(*uri)
+	if decision.Index != -1 || len(decision.Skipped) != len(mapping) {
+		t.Errorf("Wrong explanation %s %v", decision, decision.Skipped)
+	}
+	if decision.String() != "no mapping matched, default: socks://default" {
+		t.Errorf("Wrong explanation text %q", decision.String())
+	}
+	// Mismatches are not explained on dial path
+	allocs := testing.AllocsPerRun(100, func() {
+		for i := range manager.mapping {
+			if len(manager.mapping[i].Nets) == 0 && len(manager.mapping[i].Keys) == 0 {
+				manager.mapping[i].match(*uri)
+			}
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("Matching of mappings allocates %f times", allocs)
+	}
+}
+
+func TestProxyManagerFromEnv(t *testing.T) {
+	env := map[string]string{
+		"ALL_PROXY":   "socks5://all:1080",
+		"all_proxy":   "socks5://lower:1080",
+		"HTTPS_PROXY": "secure:3128",
+		"HTTP_PROXY":  "http://ignored:3128",
+		"NO_PROXY":    "example.com, .local,10.0.0.0/8,::1",
+	}
+	torProxy, _ := url.Parse("socks://tor")
+	manager, err := NewProxyManagerWithEnv(
+		func(name string) string { return env[name] },
+		[]ProxyMapping{{HostSuffixes: []string{"onion"}, Proxy: torProxy}},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, test := range []struct {
+		uri   string
+		proxy string
+	}{
+		{"tcp://host:1", "socks5://lower:1080"},
+		{"tls://host:1", "http://secure:3128"},
+		{"wss://host:1", "http://secure:3128"},
+		{"ws://host:1", "socks5://lower:1080"},
+		{"tcp://example.com:1", ""},
+		{"tls://node.example.com:1", ""},
+		{"tcp://notexample.com:1", "socks5://lower:1080"},
+		{"tcp://node.local:1", ""},
+		{"tcp://10.2.3.4:1", ""},
+		{"tcp://[::1]:1", ""},
+		{"tcp://node.onion:1", "socks://tor"},
+	} {
+		uri, _ := url.Parse(test.uri)
+		proxy := ""
+		if p := manager.Get(*uri); p != nil {
+			proxy = p.String()
+		}
+		if proxy != test.proxy {
+			t.Errorf("Uri '%s' -> proxy '%s' (%s)", test.uri, proxy, manager.Explain(*uri))
+		}
+	}
+	env = map[string]string{"ALL_PROXY": "socks5://all:1080", "no_proxy": "*"}
+	manager, _ = NewProxyManagerWithEnv(func(name string) string { return env[name] }, nil)
+	uri, _ := url.Parse("tcp://host:1")
+	if p := manager.Get(*uri); p != nil {
+		t.Errorf("NO_PROXY=* must disable proxies, got %s", p)
+	}
+	env = map[string]string{"ALL_PROXY": "socks5://[bad"}
+	if _, err := NewProxyManagerWithEnv(func(name string) string { return env[name] }, nil); err == nil {
+		t.Errorf("Invalid proxy must return error")
+	}
+}
@@ -24,14 +24,36 @@ const (
 	SECURE_LVL_ENCRYPTED                   = 1
 	SECURE_LVL_VERIFIED                    = 2
 	SECURE_LVL_ENCRYPTED_AND_VERIFIED      = 3
+	// Connection never leaves the host (unix sockets, etc)
+	SECURE_LVL_LOCAL = 4
 )
 
-// Returns current supported version of yggdrasil protocol
+// Returns default version of yggdrasil protocol
+// (v0.4 with fixed size handshake package)
 func PROTO_VERSION() ProtoVersion {
 	return ProtoVersion{0, 4}
 }
 
+// Returns v0.5 version of yggdrasil protocol
+// with TLV based signed handshake package
+func PROTO_VERSION_0_5() ProtoVersion {
+	return ProtoVersion{0, 5}
+}
+
+// Returns all supported versions of yggdrasil protocol
+func SUPPORTED_PROTO_VERSIONS() []ProtoVersion {
+	return []ProtoVersion{PROTO_VERSION(), PROTO_VERSION_0_5()}
+}
+
 // Returns static header of first pkg in yggdrasil connection
 func META_HEADER() []byte {
 	return []byte{'m', 'e', 't', 'a'}
 }
+
+// Field types of v0.5 handshake package
+const (
+	META_VERSION_MAJOR uint16 = 0 // uint16
+	META_VERSION_MINOR uint16 = 1 // uint16
+	META_PUBLIC_KEY    uint16 = 2 // [32]byte
+	META_PRIORITY      uint16 = 3 // uint8
+)
@@ -21,10 +21,41 @@ package static
 import (
 	"crypto/ed25519"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/url"
 )
 
+// Sentinel errors.
+//
+// Every error type of this package matches one of them with [errors.Is],
+// so callers can check error kind without type switches
+// even if error is wrapped.
+//
+//	if errors.Is(err, static.ErrNotAllowed) { ... }
+var (
+	ErrUnknownScheme        = errors.New("unknown scheme")
+	ErrInvalidUri           = errors.New("invalid uri")
+	ErrNotAllowed           = errors.New("peer is not allowed")
+	ErrTimeout              = errors.New("timeout")
+	ErrInapplicableProxy    = errors.New("inapplicable proxy")
+	ErrUnknownProto         = errors.New("unknown protocol")
+	ErrUnknownProtoVersion  = errors.New("unknown protocol version")
+	ErrInvalidMetaPackage   = errors.New("invalid handshake package")
+	ErrTransportKeyMismatch = errors.New("transport key mismatch")
+	ErrDuplicate            = errors.New("duplicate connection")
+	ErrUnacceptableAddress  = errors.New("unacceptable address")
+	ErrInvalidSignature     = errors.New("invalid handshake signature")
+	ErrInvalidPassword      = errors.New("invalid handshake password")
+	ErrManagerClosed        = errors.New("connection manager is closed")
+	ErrTooManyHandshakes    = errors.New("too many pending handshakes")
+	ErrDial                 = errors.New("dial failed")
+	ErrInvalidAllowList     = errors.New("invalid allow list")
+	ErrProxy                = errors.New("proxy is unreachable")
+)
+
 type UnknownSchemeError struct {
 	Scheme string
 }
@@ -37,6 +68,8 @@ func (e UnknownSchemeError) Timeout() bool { return false }
 
 func (e UnknownSchemeError) Temporary() bool { return false }
 
+func (e UnknownSchemeError) Is(target error) bool { return target == ErrUnknownScheme }
+
 type InvalidUriError struct {
 	Err string
 }
@@ -49,6 +82,8 @@ func (e InvalidUriError) Timeout() bool { return false }
 
 func (e InvalidUriError) Temporary() bool { return false }
 
+func (e InvalidUriError) Is(target error) bool { return target == ErrInvalidUri }
+
 type IvalidPeerPublicKey struct {
 	Text string
 }
@@ -61,6 +96,8 @@ func (e IvalidPeerPublicKey) Timeout() bool { return false }
 
 func (e IvalidPeerPublicKey) Temporary() bool { return false }
 
+func (e IvalidPeerPublicKey) Is(target error) bool { return target == ErrNotAllowed }
+
 type ConnTimeoutError struct{}
 
 func (e ConnTimeoutError) Error() string {
@@ -71,6 +108,8 @@ func (e ConnTimeoutError) Timeout() bool { return true }
 
 func (e ConnTimeoutError) Temporary() bool { return true }
 
+func (e ConnTimeoutError) Is(target error) bool { return target == ErrTimeout }
+
 type InapplicableProxyTypeError struct {
 	Transport string
 	Proxy     url.URL
@@ -86,6 +125,8 @@ func (e InapplicableProxyTypeError) Timeout() bool { return false }
 
 func (e InapplicableProxyTypeError) Temporary() bool { return false }
 
+func (e InapplicableProxyTypeError) Is(target error) bool { return target == ErrInapplicableProxy }
+
 type UnknownProtoError struct{}
 
 func (e UnknownProtoError) Error() string {
@@ -96,6 +137,8 @@ func (e UnknownProtoError) Timeout() bool { return false }
 
 func (e UnknownProtoError) Temporary() bool { return false }
 
+func (e UnknownProtoError) Is(target error) bool { return target == ErrUnknownProto }
+
 type UnknownProtoVersionError struct {
 	Expected ProtoVersion
 	Received ProtoVersion
@@ -113,6 +156,8 @@ func (e UnknownProtoVersionError) Timeout() bool { return false }
 
 func (e UnknownProtoVersionError) Temporary() bool { return false }
 
+func (e UnknownProtoVersionError) Is(target error) bool { return target == ErrUnknownProtoVersion }
+
 type TransportSecurityCheckError struct {
 	Expected ed25519.PublicKey
 	Received ed25519.PublicKey
@@ -130,9 +175,18 @@ func (e TransportSecurityCheckError) Timeout() bool { return false }
 
 func (e TransportSecurityCheckError) Temporary() bool { return false }
 
-type ConnClosedByDeduplicatorError struct{}
+func (e TransportSecurityCheckError) Is(target error) bool { return target == ErrTransportKeyMismatch }
+
+type ConnClosedByDeduplicatorError struct {
+	// True if established connection was closed
+	// in favor of new more secure one
+	Evicted bool
+}
 
 func (e ConnClosedByDeduplicatorError) Error() string {
+	if e.Evicted {
+		return fmt.Sprintf("Connection evicted by deduplicator")
+	}
 	return fmt.Sprintf("Connection closed by deduplicator")
 }
 
@@ -140,6 +194,8 @@ func (e ConnClosedByDeduplicatorError) Timeout() bool { return false }
 
 func (e ConnClosedByDeduplicatorError) Temporary() bool { return false }
 
+func (e ConnClosedByDeduplicatorError) Is(target error) bool { return target == ErrDuplicate }
+
 type UnacceptableAddressError struct {
 	Text string
 }
@@ -151,3 +207,249 @@ func (e UnacceptableAddressError) Error() string {
 func (e UnacceptableAddressError) Timeout() bool { return false }
 
 func (e UnacceptableAddressError) Temporary() bool { return false }
+
+func (e UnacceptableAddressError) Is(target error) bool { return target == ErrUnacceptableAddress }
+
+type InvalidSignatureError struct{}
+
+func (e InvalidSignatureError) Error() string {
+	return fmt.Sprintf("Handshake signature is invalid")
+}
+
+func (e InvalidSignatureError) Timeout() bool { return false }
+
+func (e InvalidSignatureError) Temporary() bool { return false }
+
+func (e InvalidSignatureError) Is(target error) bool { return target == ErrInvalidSignature }
+
+type InvalidPasswordError struct{}
+
+func (e InvalidPasswordError) Error() string {
+	return fmt.Sprintf("Handshake password is missing or invalid")
+}
+
+func (e InvalidPasswordError) Timeout() bool { return false }
+
+func (e InvalidPasswordError) Temporary() bool { return false }
+
+func (e InvalidPasswordError) Is(target error) bool { return target == ErrInvalidPassword }
+
+type ManagerClosedError struct{}
+
+func (e ManagerClosedError) Error() string {
+	return fmt.Sprintf("Connection manager is closed")
+}
+
+func (e ManagerClosedError) Timeout() bool { return false }
+
+func (e ManagerClosedError) Temporary() bool { return false }
+
+func (e ManagerClosedError) Is(target error) bool { return target == ErrManagerClosed }
+
+type TooManyHandshakesError struct {
+	// Source address if limit per address is exceeded
+	// or empty string if total limit is exceeded
+	Addr string
+}
+
+func (e TooManyHandshakesError) Error() string {
+	if e.Addr != "" {
+		return fmt.Sprintf("Too many pending handshakes from %s", e.Addr)
+	}
+	return fmt.Sprintf("Too many pending handshakes")
+}
+
+func (e TooManyHandshakesError) Timeout() bool { return false }
+
+func (e TooManyHandshakesError) Temporary() bool { return true }
+
+func (e TooManyHandshakesError) Is(target error) bool { return target == ErrTooManyHandshakes }
+
+type InvalidMetaPackageError struct {
+	Text string
+}
+
+func (e InvalidMetaPackageError) Error() string {
+	return fmt.Sprintf("Handshake package is invalid; %s", e.Text)
+}
+
+func (e InvalidMetaPackageError) Timeout() bool { return false }
+
+func (e InvalidMetaPackageError) Temporary() bool { return false }
+
+func (e InvalidMetaPackageError) Is(target error) bool { return target == ErrInvalidMetaPackage }
+
+type InvalidAllowListError struct {
+	Line int
+	Text string
+}
+
+func (e InvalidAllowListError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("Allow list is invalid; %s", e.Text)
+	}
+	return fmt.Sprintf("Allow list is invalid at line %d; %s", e.Line, e.Text)
+}
+
+func (e InvalidAllowListError) Timeout() bool { return false }
+
+func (e InvalidAllowListError) Temporary() bool { return false }
+
+func (e InvalidAllowListError) Is(target error) bool { return target == ErrInvalidAllowList }
+
+// Wraps network error occurred while connecting to address.
+// Original error is available with [errors.Unwrap].
+type DialError struct {
+	Addr string
+	Err  error
+}
+
+func (e DialError) Error() string {
+	return fmt.Sprintf("Failed to connect to %s: %s", e.Addr, e.Err)
+}
+
+func (e DialError) Unwrap() error { return e.Err }
+
+func (e DialError) Timeout() bool {
+	var netErr net.Error
+	return errors.As(e.Err, &netErr) && netErr.Timeout()
+}
+
+func (e DialError) Temporary() bool {
+	var netErr net.Error
+	return errors.As(e.Err, &netErr) && netErr.Temporary()
+}
+
+func (e DialError) Is(target error) bool { return target == ErrDial }
+
+// Wraps error occurred while connecting or negotiating with proxy itself
+// (not while reaching destination through it).
+// It also matches ErrDial.
+type ProxyError struct {
+	Proxy string
+	Err   error
+}
+
+func (e ProxyError) Error() string {
+	return fmt.Sprintf("Failed to connect to proxy %s: %s", e.Proxy, e.Err)
+}
+
+func (e ProxyError) Unwrap() error { return e.Err }
+
+func (e ProxyError) Timeout() bool {
+	var netErr net.Error
+	return errors.As(e.Err, &netErr) && netErr.Timeout()
+}
+
+func (e ProxyError) Temporary() bool {
+	var netErr net.Error
+	return errors.As(e.Err, &netErr) && netErr.Temporary()
+}
+
+func (e ProxyError) Is(target error) bool { return target == ErrProxy || target == ErrDial }
+
+// Classification of reasons why connection was rejected or failed.
+type RejectReason uint8
+
+const (
+	// There is no error
+	REJECT_REASON_NONE RejectReason = 0
+	// Error can not be classified
+	REJECT_REASON_UNKNOWN RejectReason = 1
+	// Network error (connection refused, reset, EOF, etc)
+	REJECT_REASON_NETWORK RejectReason = 2
+	// Connection or handshake timeout
+	REJECT_REASON_TIMEOUT RejectReason = 3
+	// Unknown protocol, version or malformed handshake package
+	REJECT_REASON_PROTOCOL RejectReason = 4
+	// Invalid handshake signature or password
+	REJECT_REASON_AUTH RejectReason = 5
+	// Node key differs from transport key
+	REJECT_REASON_TRANSPORT_KEY RejectReason = 6
+	// Node key is not allowed
+	REJECT_REASON_NOT_ALLOWED RejectReason = 7
+	// Connection duplicates other one
+	REJECT_REASON_DUPLICATE RejectReason = 8
+	// Local or remote address is not acceptable (as example ygg over ygg)
+	REJECT_REASON_ADDRESS RejectReason = 9
+	// Limits of pending handshakes are exceeded
+	REJECT_REASON_LIMIT RejectReason = 10
+	// Connection manager is closed
+	REJECT_REASON_CLOSED RejectReason = 11
+	// Invalid uri, unknown scheme or inapplicable proxy
+	REJECT_REASON_CONFIG RejectReason = 12
+)
+
+func (r RejectReason) String() string {
+	switch r {
+	case REJECT_REASON_NONE:
+		return "none"
+	case REJECT_REASON_NETWORK:
+		return "network"
+	case REJECT_REASON_TIMEOUT:
+		return "timeout"
+	case REJECT_REASON_PROTOCOL:
+		return "protocol"
+	case REJECT_REASON_AUTH:
+		return "auth"
+	case REJECT_REASON_TRANSPORT_KEY:
+		return "transport_key"
+	case REJECT_REASON_NOT_ALLOWED:
+		return "not_allowed"
+	case REJECT_REASON_DUPLICATE:
+		return "duplicate"
+	case REJECT_REASON_ADDRESS:
+		return "address"
+	case REJECT_REASON_LIMIT:
+		return "limit"
+	case REJECT_REASON_CLOSED:
+		return "closed"
+	case REJECT_REASON_CONFIG:
+		return "config"
+	}
+	return "unknown"
+}
+
+// Classifies error by its kind.
+// Wrapped errors are classified by the most specific one.
+func ReasonOf(err error) RejectReason {
+	if err == nil {
+		return REJECT_REASON_NONE
+	}
+	for _, rule := range []struct {
+		target error
+		reason RejectReason
+	}{
+		{ErrNotAllowed, REJECT_REASON_NOT_ALLOWED},
+		{ErrTransportKeyMismatch, REJECT_REASON_TRANSPORT_KEY},
+		{ErrDuplicate, REJECT_REASON_DUPLICATE},
+		{ErrInvalidSignature, REJECT_REASON_AUTH},
+		{ErrInvalidPassword, REJECT_REASON_AUTH},
+		{ErrUnknownProto, REJECT_REASON_PROTOCOL},
+		{ErrUnknownProtoVersion, REJECT_REASON_PROTOCOL},
+		{ErrInvalidMetaPackage, REJECT_REASON_PROTOCOL},
+		{ErrUnacceptableAddress, REJECT_REASON_ADDRESS},
+		{ErrTooManyHandshakes, REJECT_REASON_LIMIT},
+		{ErrManagerClosed, REJECT_REASON_CLOSED},
+		{ErrTimeout, REJECT_REASON_TIMEOUT},
+		{ErrUnknownScheme, REJECT_REASON_CONFIG},
+		{ErrInvalidUri, REJECT_REASON_CONFIG},
+		{ErrInapplicableProxy, REJECT_REASON_CONFIG},
+		{ErrInvalidAllowList, REJECT_REASON_CONFIG},
+	} {
+		if errors.Is(err, rule.target) {
+			return rule.reason
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return REJECT_REASON_TIMEOUT
+		}
+		return REJECT_REASON_NETWORK
+	}
+	if errors.Is(err, ErrDial) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) {
+		return REJECT_REASON_NETWORK
+	}
+	return REJECT_REASON_UNKNOWN
+}
@@ -0,0 +1,118 @@
+// Copyright 2022 DomesticMoth
+//
+// This file is part of Ytl.
+//
+// Ytl is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 3 of the License, or (at your option) any later version.
+//
+// Ytl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program; if not, write to the Free Software Foundation,
+// Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package static
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+)
+
+// KeyFilter decides whether node with passed key
+// is allowed to communicate with the current.
+//
+// It is implemented by AllowList and IndexedAllowList.
+type KeyFilter interface {
+	IsAllow(key ed25519.PublicKey) bool
+}
+
+// IndexedAllowList is an immutable set of allowed keys
+// with constant lookup time for lists with many keys.
+//
+// Keys are indexed by sha256 of random secret and key,
+// so lookup time does not depend on how many bytes
+// of checked key match some allowed key.
+// Found key is confirmed with constant time comparison.
+//
+// IndexedAllowList can be equal to nil.
+// As with AllowList it allows any nodes.
+type IndexedAllowList struct {
+	secret [32]byte
+	keys   map[[32]byte][ed25519.PublicKeySize]byte
+}
+
+// Builds index of AllowList.
+// Keys with wrong length are skipped as they can never be allowed.
+//
+// Returns nil if list is nil.
+func NewIndexedAllowList(list *AllowList) *IndexedAllowList {
+	if list == nil {
+		return nil
+	}
+	a := &IndexedAllowList{
+		keys: make(map[[32]byte][ed25519.PublicKeySize]byte, len(*list)),
+	}
+	if _, err := rand.Read(a.secret[:]); err != nil {
+		// Unreachable on supported platforms
+		panic(err)
+	}
+	for _, key := range *list {
+		if len(key) != ed25519.PublicKeySize {
+			continue
+		}
+		var value [ed25519.PublicKeySize]byte
+		copy(value[:], key)
+		a.keys[a.index(key)] = value
+	}
+	return a
+}
+
+func (a *IndexedAllowList) index(key ed25519.PublicKey) [32]byte {
+	var buf [32 + ed25519.PublicKeySize]byte
+	copy(buf[:32], a.secret[:])
+	copy(buf[32:], key)
+	return sha256.Sum256(buf[:])
+}
+
+// Checks whether the passed key is in the allowed list.
+//
+// If IndexedAllowList is nil, it always returns true.
+func (a *IndexedAllowList) IsAllow(key ed25519.PublicKey) bool {
+	if a == nil {
+		return true
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return false
+	}
+	value, ok := a.keys[a.index(key)]
+	return ok && subtle.ConstantTimeCompare(value[:], key) == 1
+}
+
+// Returns count of keys in list
+func (a *IndexedAllowList) Len() int {
+	if a == nil {
+		return 0
+	}
+	return len(a.keys)
+}
+
+// Returns keys of list in random order (nil if list is nil)
+func (a *IndexedAllowList) Keys() AllowList {
+	if a == nil {
+		return nil
+	}
+	keys := make(AllowList, 0, len(a.keys))
+	for _, value := range a.keys {
+		key := make(ed25519.PublicKey, ed25519.PublicKeySize)
+		copy(key, value[:])
+		keys = append(keys, key)
+	}
+	return keys
+}
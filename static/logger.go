@@ -0,0 +1,139 @@
+// Copyright 2022 DomesticMoth
+//
+// This file is part of Ytl.
+//
+// Ytl is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 3 of the License, or (at your option) any later version.
+//
+// Ytl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program; if not, write to the Free Software Foundation,
+// Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package static
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+)
+
+// Severity of log message
+type LogLevel uint8
+
+const (
+	LOG_LEVEL_DEBUG LogLevel = 0
+	LOG_LEVEL_INFO  LogLevel = 1
+	LOG_LEVEL_WARN  LogLevel = 2
+	LOG_LEVEL_ERROR LogLevel = 3
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LOG_LEVEL_DEBUG:
+		return "DEBUG"
+	case LOG_LEVEL_INFO:
+		return "INFO"
+	case LOG_LEVEL_WARN:
+		return "WARN"
+	case LOG_LEVEL_ERROR:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", uint8(l))
+}
+
+// Returns copy of uri that is safe to log or pass to observers.
+// "password" query param is removed
+// and userinfo password is masked as in [url.URL.Redacted].
+func RedactUri(uri url.URL) *url.URL {
+	if query := uri.Query(); len(query["password"]) > 0 {
+		query.Del("password")
+		uri.RawQuery = query.Encode()
+	}
+	if uri.User != nil {
+		if _, has := uri.User.Password(); has {
+			uri.User = url.UserPassword(uri.User.Username(), "xxxxx")
+		}
+	}
+	return &uri
+}
+
+// Structured logger used by ytl internals.
+//
+// kv is a list of alternating keys and values,
+// for example "uri", static.RedactUri(uri).String(), "key", pkey.
+//
+// Implementations must be safe for concurrent use.
+type Logger interface {
+	Log(level LogLevel, msg string, kv ...interface{})
+}
+
+// Logger that drops all messages.
+// It is used by default.
+type NopLogger struct{}
+
+func (NopLogger) Log(LogLevel, string, ...interface{}) {}
+
+// Returns logger as is or NopLogger if it is nil.
+func LoggerOrNop(logger Logger) Logger {
+	if logger == nil {
+		return NopLogger{}
+	}
+	return logger
+}
+
+// Adapter that writes messages to standard library logger
+// in "LEVEL message key=value key=value" format.
+//
+// If Logger is nil, log.Default() is used.
+// Messages with level lower than Level are dropped.
+type StdLogger struct {
+	Logger *log.Logger
+	Level  LogLevel
+}
+
+func (l StdLogger) Log(level LogLevel, msg string, kv ...interface{}) {
+	if level < l.Level {
+		return
+	}
+	logger := l.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteString(" ")
+	b.WriteString(msg)
+	for i := 0; i < len(kv); i += 2 {
+		var value interface{} = "MISSING"
+		if i+1 < len(kv) {
+			value = kv[i+1]
+		}
+		switch v := value.(type) {
+		case ed25519.PublicKey:
+			value = fmt.Sprintf("%x", []byte(v))
+		case []byte:
+			value = fmt.Sprintf("%x", v)
+		}
+		fmt.Fprintf(&b, " %v=%v", kv[i], value)
+	}
+	logger.Output(2, b.String())
+}
+
+// Transport that can write logs.
+//
+// ConnManager passes its logger to transports
+// that implement this interface.
+type LoggingTransport interface {
+	Transport
+	// Returns copy of transport that writes logs to passed logger
+	WithLogger(logger Logger) Transport
+}
@@ -0,0 +1,169 @@
+// Copyright 2022 DomesticMoth
+//
+// This file is part of Ytl.
+//
+// Ytl is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 3 of the License, or (at your option) any later version.
+//
+// Ytl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program; if not, write to the Free Software Foundation,
+// Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package static
+
+import (
+	"crypto/ed25519"
+	"crypto/subtle"
+	"net"
+	"strings"
+)
+
+// Policy combines key and address filters
+// that are applied to connections with other nodes.
+//
+// Deny rules take precedence over allow rules.
+// Empty allow rules allow everything.
+// Address rules are applied only to connections over ip
+// (as example unix socket connections are not checked).
+//
+// Nil Policy allows everything.
+type Policy struct {
+	// Keys that are allowed (nil means any key).
+	// Use IndexedAllowList for large lists.
+	AllowKeys KeyFilter
+	// Keys that are always rejected
+	DenyKeys []ed25519.PublicKey
+	// Networks of remote addresses that are allowed
+	// (empty means any address)
+	AllowNets []*net.IPNet
+	// Networks of remote addresses that are always rejected
+	DenyNets []*net.IPNet
+}
+
+// Parses list of CIDRs like "10.0.0.0/8" or "fd00::/8".
+// Single ip addresses are treated as networks with full mask.
+func ParseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, InvalidUriError{Err: "invalid ip address " + cidr}
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, InvalidUriError{Err: "invalid cidr " + cidr}
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func netsContain(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks whether the passed key is allowed.
+func (p *Policy) IsKeyAllowed(key ed25519.PublicKey) bool {
+	if p == nil {
+		return true
+	}
+	for _, denied := range p.DenyKeys {
+		if subtle.ConstantTimeCompare(denied, key) == 1 {
+			return false
+		}
+	}
+	return p.AllowKeys == nil || p.AllowKeys.IsAllow(key)
+}
+
+// Checks whether the passed remote ip is allowed.
+// Nil ip is always allowed.
+func (p *Policy) IsIpAllowed(ip net.IP) bool {
+	if p == nil || ip == nil {
+		return true
+	}
+	if netsContain(p.DenyNets, ip) {
+		return false
+	}
+	return len(p.AllowNets) == 0 || netsContain(p.AllowNets, ip)
+}
+
+// Returns IvalidPeerPublicKey error if key is not allowed.
+func (p *Policy) CheckKey(key ed25519.PublicKey) error {
+	if !p.IsKeyAllowed(key) {
+		return IvalidPeerPublicKey{
+			Text: "Key received from the peer is denied by policy",
+		}
+	}
+	return nil
+}
+
+// Returns UnacceptableAddressError if ip is not allowed.
+func (p *Policy) CheckIp(ip net.IP) error {
+	if !p.IsIpAllowed(ip) {
+		return UnacceptableAddressError{
+			Text: ip.String() + " is denied by policy",
+		}
+	}
+	return nil
+}
+
+// Returns ip of address or nil if it is not an ip address.
+func IpFromAddr(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		if a != nil {
+			return a.IP
+		}
+		return nil
+	case *net.UDPAddr:
+		if a != nil {
+			return a.IP
+		}
+		return nil
+	case *net.IPAddr:
+		if a != nil {
+			return a.IP
+		}
+		return nil
+	}
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
+
+// Transport that can check remote addresses
+// with policy before connecting.
+//
+// ConnManager passes its policy to transports
+// that implement this interface.
+type PolicyTransport interface {
+	Transport
+	// Returns copy of transport that checks addresses with passed policy
+	WithPolicy(policy *Policy) Transport
+}
@@ -23,12 +23,17 @@
 package static
 
 import (
+	"bufio"
 	"context"
 	"crypto/ed25519"
 	"crypto/subtle"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"net"
 	"net/url"
+	"strings"
+	"time"
 )
 
 // ProtoVersion is the representation of yggdrasil protocol semantic version.
@@ -46,6 +51,9 @@ func (e ProtoVersion) String() string {
 //
 // AllowList can be equal to nil.
 // This should be interpreted as a connection permission for any nodes.
+//
+// Lookup time grows with list length,
+// use IndexedAllowList to check keys in large lists.
 type AllowList []ed25519.PublicKey
 
 // Checks whether the passed key is in the allowed list.
@@ -66,6 +74,59 @@ func (a *AllowList) IsAllow(key ed25519.PublicKey) bool {
 	return false
 }
 
+// Line of allow list text that marks list as empty intentionally
+const ALLOW_LIST_NONE = "none"
+
+// Parses AllowList from text with one hex encoded key per line.
+// Text after '#' is a comment, empty lines are ignored.
+//
+//	# alice
+//	a3f6...e1 # laptop
+//
+// Empty text gives empty (not nil) AllowList that denies everything.
+// ALLOW_LIST_NONE line is ignored.
+func ParseAllowList(r io.Reader) (AllowList, error) {
+	list, _, err := ParseAllowListExplicit(r)
+	return list, err
+}
+
+// Parses AllowList as ParseAllowList does and reports
+// whether text contains ALLOW_LIST_NONE line,
+// so intentionally empty list can be told from truncated text.
+func ParseAllowListExplicit(r io.Reader) (AllowList, bool, error) {
+	list := make(AllowList, 0)
+	none := false
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line += 1
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		if text == ALLOW_LIST_NONE {
+			none = true
+			continue
+		}
+		key, err := hex.DecodeString(text)
+		if err != nil {
+			return nil, false, InvalidAllowListError{Line: line, Text: "key is not a hex string"}
+		}
+		if len(key) != ed25519.PublicKeySize {
+			return nil, false, InvalidAllowListError{Line: line, Text: "wrong key length"}
+		}
+		list = append(list, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, false, err
+	}
+	return list, none, nil
+}
+
 // ConnResult contains information received
 // when establishing a transport connection with another node
 type ConnResult struct {
@@ -79,6 +140,7 @@ type ConnResult struct {
 	// - ytl.static.SECURE_LVL_ENCRYPTED
 	// - ytl.static.SECURE_LVL_VERIFIED
 	// - ytl.static.SECURE_LVL_ENCRYPTED_AND_VERIFIED
+	// - ytl.static.SECURE_LVL_LOCAL
 	SecurityLevel uint
 }
 
@@ -141,3 +203,41 @@ type Transport interface {
 	// Returns listener object for accepting incoming transport connections.
 	Listen(ctx context.Context, uri url.URL, key ed25519.PrivateKey) (TransportListener, error)
 }
+
+// Dial options passed by ConnManager to transports.
+// Zero values mean transport defaults.
+//
+// Transports must let uri params of single connection
+// override these options.
+type DialConfig struct {
+	// Timeout of establishing tcp connection
+	Timeout time.Duration
+	// Extra time for negotiation with proxy
+	ProxyTimeout time.Duration
+	// Tcp keepalive period, negative value disables keepalive
+	KeepAlive time.Duration
+}
+
+// Transport that accepts dial options.
+//
+// ConnManager passes options from its config
+// to transports that implement this interface.
+type ConfigurableTransport interface {
+	Transport
+	// Returns copy of transport that uses passed options
+	WithConfig(config DialConfig) Transport
+}
+
+// Transport that can connect through chain of proxies.
+//
+// ConnManager uses this interface if ProxyManager
+// returns chain with more than one proxy.
+type ProxyChainTransport interface {
+	Transport
+	// Establishes transport connection through proxies in passed order.
+	// The last proxy connects to uri host.
+	ConnectChain(
+		ctx context.Context, uri url.URL,
+		chain []*url.URL, key ed25519.PrivateKey,
+	) (ConnResult, error)
+}
@@ -30,17 +30,60 @@ import (
 // Exactly what the name implies
 const TcpScheme = "tcp"
 
+// Opens tcp listener with keepalive period
+// from "keepalive" uri param or from config
+func tcpListen(ctx context.Context, uri url.URL, dialConfig static.DialConfig) (net.Listener, error) {
+	keepAlive, err := dialers.DurationFromUri(uri, dialers.KEEP_ALIVE_PARAM)
+	if err != nil {
+		return nil, err
+	}
+	if keepAlive == 0 {
+		keepAlive = dialConfig.KeepAlive
+	}
+	config := net.ListenConfig{KeepAlive: keepAlive}
+	return config.Listen(ctx, TcpScheme, uri.Host)
+}
+
 // Implements tcp yggdrasil transport
 // Compatible with the same named transport in yggdrasil-go
-type TcpTransport struct{}
+type TcpTransport struct {
+	// Optional logger (nil means no logs)
+	Logger static.Logger
+	// Optional policy that remote addresses are checked with
+	Policy *static.Policy
+	// Dial options (uri params override them)
+	Config static.DialConfig
+}
 
 func (t TcpTransport) GetScheme() string {
 	return TcpScheme
 }
 
+func (t TcpTransport) WithLogger(logger static.Logger) static.Transport {
+	t.Logger = logger
+	return t
+}
+
+func (t TcpTransport) WithPolicy(policy *static.Policy) static.Transport {
+	t.Policy = policy
+	return t
+}
+
+func (t TcpTransport) WithConfig(config static.DialConfig) static.Transport {
+	t.Config = config
+	return t
+}
+
 func (t TcpTransport) Connect(ctx context.Context, uri url.URL, proxy *url.URL, key ed25519.PrivateKey) (static.ConnResult, error) {
-	dialer := dialers.TcpDialer{}
-	conn, err := dialer.DialContext(ctx, uri, proxy)
+	return t.ConnectChain(ctx, uri, proxyChain(proxy), key)
+}
+
+func (t TcpTransport) ConnectChain(ctx context.Context, uri url.URL, chain []*url.URL, key ed25519.PrivateKey) (static.ConnResult, error) {
+	dialer, err := dialers.TcpDialer{Logger: t.Logger, Policy: t.Policy}.WithConfig(t.Config).WithUriParams(uri)
+	if err != nil {
+		return static.ConnResult{}, err
+	}
+	conn, err := dialer.DialChainContext(ctx, uri, chain)
 	return static.ConnResult{
 		Conn:          conn,
 		Pkey:          nil,
@@ -48,7 +91,15 @@ func (t TcpTransport) Connect(ctx context.Context, uri url.URL, proxy *url.URL,
 	}, err
 }
 
+// Returns chain with single proxy or nil if proxy is nil
+func proxyChain(proxy *url.URL) []*url.URL {
+	if proxy == nil {
+		return nil
+	}
+	return []*url.URL{proxy}
+}
+
 func (t TcpTransport) Listen(ctx context.Context, uri url.URL, key ed25519.PrivateKey) (static.TransportListener, error) {
-	l, e := net.Listen(TcpScheme, uri.Host)
+	l, e := tcpListen(ctx, uri, t.Config)
 	return static.ListenerToTransportListener(l, static.SECURE_LVL_UNSECURE), e
 }
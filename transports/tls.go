@@ -0,0 +1,289 @@
+// Copyright 2022 DomesticMoth
+//
+// This file is part of Ytl.
+//
+// Ytl is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 3 of the License, or (at your option) any later version.
+//
+// Ytl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program; if not, write to the Free Software Foundation,
+// Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package transports
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"github.com/DomesticMoth/ytl/dialers"
+	"github.com/DomesticMoth/ytl/static"
+	"math/big"
+	"net"
+	"net/url"
+	"time"
+)
+
+// Exactly what the name implies
+const TlsScheme = "tls"
+
+// Max time for tls handshake with incoming connection
+const tlsHandshakeTimeout = time.Minute
+
+// Generates self-signed certificate from node key
+// in the same way as yggdrasil-go does.
+func tlsCertificateFromKey(key ed25519.PrivateKey) (tls.Certificate, error) {
+	pub := key.Public().(ed25519.PublicKey)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName: hex.EncodeToString(pub),
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour * 24 * 365),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, pub, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
+
+// Returns tls config compatible with yggdrasil-go tls transport.
+//
+// Peer certificates are not verified by chain,
+// peer key is checked by YggConn instead.
+func tlsConfigFromKey(key ed25519.PrivateKey) (*tls.Config, error) {
+	cert, err := tlsCertificateFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		ClientAuth:         tls.RequestClientCert,
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS13,
+	}, nil
+}
+
+// Returns SNI from "sni" uri param or uri hostname.
+// IP addresses are never used as SNI.
+func tlsServerName(uri url.URL) string {
+	if sni := uri.Query().Get("sni"); sni != "" && net.ParseIP(sni) == nil {
+		return sni
+	}
+	if host := uri.Hostname(); net.ParseIP(host) == nil {
+		return host
+	}
+	return ""
+}
+
+// Performs tls handshake limited by deadline of ctx.
+// Deadline of conn is cleared after handshake.
+func tlsHandshake(ctx context.Context, conn *tls.Conn) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// Unblock handshake if ctx is cancelled
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	err := conn.Handshake()
+	close(stop)
+	<-stopped
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// Builds ConnResult with peer certificate key as transport key
+func tlsConnResult(conn *tls.Conn) static.ConnResult {
+	state := conn.ConnectionState()
+	if len(state.PeerCertificates) > 0 {
+		if pkey, ok := state.PeerCertificates[0].PublicKey.(ed25519.PublicKey); ok {
+			return static.ConnResult{
+				Conn:          conn,
+				Pkey:          pkey,
+				SecurityLevel: static.SECURE_LVL_ENCRYPTED_AND_VERIFIED,
+			}
+		}
+	}
+	return static.ConnResult{
+		Conn:          conn,
+		Pkey:          nil,
+		SecurityLevel: static.SECURE_LVL_ENCRYPTED,
+	}
+}
+
+// Implements tls yggdrasil transport
+// Compatible with the same named transport in yggdrasil-go
+type TlsTransport struct {
+	// Optional logger (nil means no logs)
+	Logger static.Logger
+	// Optional policy that remote addresses are checked with
+	Policy *static.Policy
+	// Dial options (uri params override them)
+	Config static.DialConfig
+}
+
+func (t TlsTransport) GetScheme() string {
+	return TlsScheme
+}
+
+func (t TlsTransport) WithLogger(logger static.Logger) static.Transport {
+	t.Logger = logger
+	return t
+}
+
+func (t TlsTransport) WithPolicy(policy *static.Policy) static.Transport {
+	t.Policy = policy
+	return t
+}
+
+func (t TlsTransport) WithConfig(config static.DialConfig) static.Transport {
+	t.Config = config
+	return t
+}
+
+func (t TlsTransport) Connect(ctx context.Context, uri url.URL, proxy *url.URL, key ed25519.PrivateKey) (static.ConnResult, error) {
+	return t.ConnectChain(ctx, uri, proxyChain(proxy), key)
+}
+
+func (t TlsTransport) ConnectChain(ctx context.Context, uri url.URL, chain []*url.URL, key ed25519.PrivateKey) (static.ConnResult, error) {
+	config, err := tlsConfigFromKey(key)
+	if err != nil {
+		return static.ConnResult{}, err
+	}
+	config.ServerName = tlsServerName(uri)
+	dialer, err := dialers.TcpDialer{Logger: t.Logger, Policy: t.Policy}.WithConfig(t.Config).WithUriParams(uri)
+	if err != nil {
+		return static.ConnResult{}, err
+	}
+	conn, err := dialer.DialChainContext(ctx, uri, chain)
+	if err != nil {
+		return static.ConnResult{}, err
+	}
+	tlsConn := tls.Client(conn, config)
+	if err = tlsHandshake(ctx, tlsConn); err != nil {
+		conn.Close()
+		return static.ConnResult{}, err
+	}
+	return tlsConnResult(tlsConn), nil
+}
+
+func (t TlsTransport) Listen(ctx context.Context, uri url.URL, key ed25519.PrivateKey) (static.TransportListener, error) {
+	config, err := tlsConfigFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	l, err := tcpListen(ctx, uri, t.Config)
+	if err != nil {
+		return nil, err
+	}
+	return newTlsListener(l, config, static.LoggerOrNop(t.Logger)), nil
+}
+
+// Accepts tcp connections and performs tls handshakes
+// in background, so slow clients do not block each other.
+type tlsListener struct {
+	inner  net.Listener
+	config *tls.Config
+	ready  chan static.ConnResult
+	done   chan struct{}
+	err    error
+	logger static.Logger
+}
+
+func newTlsListener(inner net.Listener, config *tls.Config, logger static.Logger) *tlsListener {
+	l := &tlsListener{
+		inner,
+		config,
+		make(chan static.ConnResult),
+		make(chan struct{}),
+		nil,
+		logger,
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *tlsListener) acceptLoop() {
+	defer close(l.done)
+	for {
+		conn, err := l.inner.Accept()
+		if err != nil {
+			l.err = err
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *tlsListener) handshake(conn net.Conn) {
+	tlsConn := tls.Server(conn, l.config)
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	err := tlsHandshake(ctx, tlsConn)
+	cancel()
+	if err != nil {
+		l.logger.Log(
+			static.LOG_LEVEL_DEBUG, "TLS handshake failed",
+			"remote", conn.RemoteAddr().String(), "err", err,
+		)
+		conn.Close()
+		return
+	}
+	select {
+	case l.ready <- tlsConnResult(tlsConn):
+	case <-l.done:
+		tlsConn.Close()
+	}
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptConn()
+	return conn.Conn, err
+}
+
+func (l *tlsListener) AcceptConn() (static.ConnResult, error) {
+	select {
+	case conn := <-l.ready:
+		return conn, nil
+	case <-l.done:
+		return static.ConnResult{}, l.err
+	}
+}
+
+func (l *tlsListener) Close() error {
+	return l.inner.Close()
+}
+
+func (l *tlsListener) Addr() net.Addr {
+	return l.inner.Addr()
+}
@@ -0,0 +1,124 @@
+// Copyright 2022 DomesticMoth
+//
+// This file is part of Ytl.
+//
+// Ytl is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 3 of the License, or (at your option) any later version.
+//
+// Ytl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program; if not, write to the Free Software Foundation,
+// Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package transports
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"errors"
+	"github.com/DomesticMoth/ytl/static"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTlsServerName(t *testing.T) {
+	cases := map[string]string{
+		"tls://example.com:1337":                  "example.com",
+		"tls://127.0.0.1:1337":                    "",
+		"tls://[::1]:1337":                        "",
+		"tls://127.0.0.1:1337?sni=example.com":    "example.com",
+		"tls://example.com:1337?sni=127.0.0.1":    "example.com",
+		"tls://example.com:1337?sni=other.domain": "other.domain",
+	}
+	for raw, correct := range cases {
+		uri, _ := url.Parse(raw)
+		if sni := tlsServerName(*uri); sni != correct {
+			t.Errorf("Wrong SNI for '%s': '%s' '%s'", raw, sni, correct)
+		}
+	}
+}
+
+func TestTlsTransportLoopback(t *testing.T) {
+	serverPub, serverPriv, _ := ed25519.GenerateKey(nil)
+	clientPub, clientPriv, _ := ed25519.GenerateKey(nil)
+	transport := TlsTransport{}
+	listenUri, _ := url.Parse("tls://127.0.0.1:0")
+	listener, err := transport.Listen(context.Background(), *listenUri, serverPriv)
+	if err != nil {
+		t.Fatalf("Error while listening: %s", err)
+	}
+	defer listener.Close()
+	data := []byte("meta")
+	accepted := make(chan static.ConnResult, 1)
+	go func() {
+		conn, err := listener.AcceptConn()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		conn.Conn.Write(data)
+		accepted <- conn
+	}()
+	uri, _ := url.Parse("tls://" + listener.Addr().String())
+	client, err := transport.Connect(context.Background(), *uri, nil, clientPriv)
+	if err != nil {
+		t.Fatalf("Error while connecting: %s", err)
+	}
+	defer client.Conn.Close()
+	if bytes.Compare(client.Pkey, serverPub) != 0 {
+		t.Errorf("Wrong server transport key")
+	}
+	if client.SecurityLevel != static.SECURE_LVL_ENCRYPTED_AND_VERIFIED {
+		t.Errorf("Wrong client security lvl %d", client.SecurityLevel)
+	}
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(client.Conn, buf); err != nil {
+		t.Fatalf("Error while reading: %s", err)
+	}
+	if bytes.Compare(buf, data) != 0 {
+		t.Errorf("Readed data is not eq to writed data")
+	}
+	server, ok := <-accepted
+	if !ok {
+		t.Fatalf("Connection was not accepted")
+	}
+	defer server.Conn.Close()
+	if bytes.Compare(server.Pkey, clientPub) != 0 {
+		t.Errorf("Wrong client transport key")
+	}
+	if server.SecurityLevel != static.SECURE_LVL_ENCRYPTED_AND_VERIFIED {
+		t.Errorf("Wrong server security lvl %d", server.SecurityLevel)
+	}
+}
+
+func TestTlsHandshakeContext(t *testing.T) {
+	// Server never answers
+	client, server := net.Pipe()
+	defer server.Close()
+	go io.Copy(io.Discard, server)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	var netErr net.Error
+	if err := tlsHandshake(ctx, tls.Client(client, &tls.Config{InsecureSkipVerify: true})); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Wrong error after deadline %v", err)
+	}
+	client, server = net.Pipe()
+	defer server.Close()
+	go io.Copy(io.Discard, server)
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*100, cancel)
+	if err := tlsHandshake(ctx, tls.Client(client, &tls.Config{InsecureSkipVerify: true})); !errors.Is(err, context.Canceled) {
+		t.Errorf("Wrong error after cancel %v", err)
+	}
+}
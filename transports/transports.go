@@ -28,5 +28,9 @@ import (
 func DEFAULT_TRANSPORTS() []static.Transport {
 	return []static.Transport{
 		TcpTransport{},
+		TlsTransport{},
+		WsTransport{},
+		WssTransport{},
+		UnixTransport{},
 	}
 }
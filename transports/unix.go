@@ -0,0 +1,164 @@
+// Copyright 2022 DomesticMoth
+//
+// This file is part of Ytl.
+//
+// Ytl is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 3 of the License, or (at your option) any later version.
+//
+// Ytl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program; if not, write to the Free Software Foundation,
+// Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package transports
+
+import (
+	"context"
+	"crypto/ed25519"
+	"github.com/DomesticMoth/ytl/static"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Exactly what the name implies
+const UnixScheme = "unix"
+
+// Returns socket path from uri
+func unixSocketPath(uri url.URL) (string, error) {
+	if uri.Path == "" {
+		return "", static.InvalidUriError{Err: "unix socket path is empty"}
+	}
+	return uri.Path, nil
+}
+
+// Implements unix domain socket yggdrasil transport
+// Compatible with the same named transport in yggdrasil-go
+//
+// Socket path is taken from uri path, as example "unix:///run/ygg.sock".
+// Proxies are ignored because connection never leaves the host.
+type UnixTransport struct {
+	// Permissions of socket file created by Listen.
+	// If zero, permissions are left as is.
+	// May be overridden by "mode" uri param (octal, as example "mode=0660").
+	Mode os.FileMode
+	// Optional logger (nil means no logs)
+	Logger static.Logger
+}
+
+// Returns socket file permissions for uri
+func (t UnixTransport) mode(uri url.URL) (os.FileMode, error) {
+	raw := uri.Query().Get("mode")
+	if raw == "" {
+		return t.Mode, nil
+	}
+	mode, err := strconv.ParseUint(raw, 8, 32)
+	if err != nil {
+		return 0, static.InvalidUriError{Err: "unix socket mode must be octal number"}
+	}
+	return os.FileMode(mode), nil
+}
+
+func (t UnixTransport) GetScheme() string {
+	return UnixScheme
+}
+
+func (t UnixTransport) WithLogger(logger static.Logger) static.Transport {
+	t.Logger = logger
+	return t
+}
+
+func (t UnixTransport) Connect(ctx context.Context, uri url.URL, proxy *url.URL, key ed25519.PrivateKey) (static.ConnResult, error) {
+	path, err := unixSocketPath(uri)
+	if err != nil {
+		return static.ConnResult{}, err
+	}
+	static.LoggerOrNop(t.Logger).Log(static.LOG_LEVEL_DEBUG, "Dialing", "uri", static.RedactUri(uri).String())
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, UnixScheme, path)
+	if err != nil {
+		return static.ConnResult{}, err
+	}
+	return static.ConnResult{
+		Conn:          conn,
+		Pkey:          nil,
+		SecurityLevel: static.SECURE_LVL_LOCAL,
+	}, nil
+}
+
+func (t UnixTransport) Listen(ctx context.Context, uri url.URL, key ed25519.PrivateKey) (static.TransportListener, error) {
+	path, err := unixSocketPath(uri)
+	if err != nil {
+		return nil, err
+	}
+	mode, err := t.mode(uri)
+	if err != nil {
+		return nil, err
+	}
+	if mode == 0 {
+		l, err := net.Listen(UnixScheme, path)
+		if err != nil {
+			return nil, err
+		}
+		return static.ListenerToTransportListener(l, static.SECURE_LVL_LOCAL), nil
+	}
+	l, err := unixListenWithMode(path, mode)
+	if err != nil {
+		return nil, err
+	}
+	return static.ListenerToTransportListener(l, static.SECURE_LVL_LOCAL), nil
+}
+
+// Unix listener which socket was created under other name
+// and then linked to path
+type unixListener struct {
+	*net.UnixListener
+	addr *net.UnixAddr
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return l.addr
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.addr.Name)
+	return err
+}
+
+// Creates socket with passed permissions.
+// Socket is created in private directory and appears
+// at path only after its permissions are set,
+// so nobody can connect to it before.
+func unixListenWithMode(path string, mode os.FileMode) (net.Listener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".ytl-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+	l, err := net.ListenUnix(UnixScheme, &net.UnixAddr{Name: tmp, Net: UnixScheme})
+	if err != nil {
+		return nil, err
+	}
+	l.SetUnlinkOnClose(false)
+	if err = os.Chmod(tmp, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	// Unlike rename, link fails if path already exists
+	if err = os.Link(tmp, path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &unixListener{l, &net.UnixAddr{Name: path, Net: UnixScheme}}, nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2022 DomesticMoth
+//
+// This file is part of Ytl.
+//
+// Ytl is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 3 of the License, or (at your option) any later version.
+//
+// Ytl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program; if not, write to the Free Software Foundation,
+// Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package transports
+
+import (
+	"context"
+	"crypto/ed25519"
+	"github.com/DomesticMoth/ytl/static"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnixTransportLoopback(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	path := filepath.Join(t.TempDir(), "ygg.sock")
+	uri, _ := url.Parse("unix://" + path + "?mode=0600")
+	transport := UnixTransport{Mode: 0666}
+	listener, err := transport.Listen(context.Background(), *uri, key)
+	if err != nil {
+		t.Fatalf("Error while listening: %s", err)
+	}
+	defer listener.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Error while reading socket info: %s", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Wrong socket permissions %s", info.Mode().Perm())
+	}
+	accepted := make(chan static.ConnResult, 1)
+	go func() {
+		conn, _ := listener.AcceptConn()
+		accepted <- conn
+	}()
+	client, err := transport.Connect(context.Background(), *uri, nil, key)
+	if err != nil {
+		t.Fatalf("Error while connecting: %s", err)
+	}
+	defer client.Conn.Close()
+	server := <-accepted
+	if server.Conn == nil {
+		t.Fatalf("Connection was not accepted")
+	}
+	defer server.Conn.Close()
+	for _, conn := range []static.ConnResult{client, server} {
+		if conn.SecurityLevel != static.SECURE_LVL_LOCAL {
+			t.Errorf("Wrong security lvl %d", conn.SecurityLevel)
+		}
+	}
+}
+
+func TestUnixTransportInvalidUri(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	transport := UnixTransport{}
+	for _, raw := range []string{
+		"unix://",
+		"unix:///tmp/ygg.sock?mode=rw",
+	} {
+		uri, _ := url.Parse(raw)
+		if l, err := transport.Listen(context.Background(), *uri, key); err == nil {
+			l.Close()
+			t.Errorf("Listening on '%s' should cause an error", raw)
+		}
+	}
+}
+
+func TestUnixTransportModeListener(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ygg.sock")
+	uri, _ := url.Parse("unix://" + path + "?mode=0600")
+	transport := UnixTransport{}
+	listener, err := transport.Listen(context.Background(), *uri, key)
+	if err != nil {
+		t.Fatalf("Error while listening: %s", err)
+	}
+	if listener.Addr().String() != path {
+		t.Errorf("Wrong listener addr %s", listener.Addr())
+	}
+	if _, err := transport.Listen(context.Background(), *uri, key); err == nil {
+		t.Errorf("Listening on busy path must fail")
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Temporary files are left in socket directory: %v", entries)
+	}
+	listener.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Socket file was not removed on close")
+	}
+}
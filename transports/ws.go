@@ -0,0 +1,388 @@
+// Copyright 2022 DomesticMoth
+//
+// This file is part of Ytl.
+//
+// Ytl is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 3 of the License, or (at your option) any later version.
+//
+// Ytl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program; if not, write to the Free Software Foundation,
+// Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package transports
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"fmt"
+	"github.com/DomesticMoth/ytl/dialers"
+	"github.com/DomesticMoth/ytl/static"
+	"golang.org/x/net/websocket"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Exactly what the name implies
+const WsScheme = "ws"
+
+// Exactly what the name implies
+const WssScheme = "wss"
+
+// WebSocket subprotocol used by yggdrasil-go
+const wsProtocol = "ygg-ws"
+
+// Default time limit for reading http request headers
+// (and tls handshake for wss) of incoming connections.
+// Clients that do not send headers in time are disconnected.
+const DEFAULT_WS_HEADER_TIMEOUT = 10 * time.Second
+
+// Name of uri param that overrides DEFAULT_WS_HEADER_TIMEOUT for listener
+const WS_HEADER_TIMEOUT_PARAM = "header_timeout"
+
+// Returns header timeout from uri param or default value
+func wsHeaderTimeout(uri url.URL) (time.Duration, error) {
+	timeout, err := dialers.DurationFromUri(uri, WS_HEADER_TIMEOUT_PARAM)
+	if err != nil {
+		return 0, err
+	}
+	if timeout <= 0 {
+		return DEFAULT_WS_HEADER_TIMEOUT, nil
+	}
+	return timeout, nil
+}
+
+// Returns uri path or "/" if it is empty
+func wsPath(uri url.URL) string {
+	if uri.Path == "" {
+		return "/"
+	}
+	return uri.Path
+}
+
+// Returns uri with default port for scheme if it is not set
+func wsUriWithPort(uri url.URL, defaultPort string) url.URL {
+	if uri.Port() == "" {
+		uri.Host = net.JoinHostPort(uri.Hostname(), defaultPort)
+	}
+	return uri
+}
+
+// Wraps websocket connection so that it
+// reports real network addresses
+// and notifies about closing.
+type wsConn struct {
+	*websocket.Conn
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+func newWsConn(conn *websocket.Conn, localAddr, remoteAddr net.Addr) *wsConn {
+	conn.PayloadType = websocket.BinaryFrame
+	return &wsConn{
+		Conn:       conn,
+		localAddr:  localAddr,
+		remoteAddr: remoteAddr,
+		closed:     make(chan struct{}),
+	}
+}
+
+func (c *wsConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *wsConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() { close(c.closed) })
+	return err
+}
+
+// Establishes websocket connection over already opened transport connection
+func wsClientHandshake(ctx context.Context, conn net.Conn, uri url.URL, origin string) (*wsConn, error) {
+	location := url.URL{Scheme: uri.Scheme, Host: uri.Host, Path: wsPath(uri)}
+	config, err := websocket.NewConfig(location.String(), origin)
+	if err != nil {
+		return nil, err
+	}
+	config.Protocol = []string{wsProtocol}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return newWsConn(ws, conn.LocalAddr(), conn.RemoteAddr()), nil
+}
+
+// Dials tcp connection to host of websocket uri
+func wsDial(ctx context.Context, uri url.URL, chain []*url.URL, defaultPort string, dialer dialers.TcpDialer) (net.Conn, url.URL, error) {
+	uri = wsUriWithPort(uri, defaultPort)
+	dialer, err := dialer.WithUriParams(uri)
+	if err != nil {
+		return nil, uri, err
+	}
+	conn, err := dialer.DialChainContext(ctx, uri, chain)
+	return conn, uri, err
+}
+
+// Accepts http connections and upgrades
+// requests on configured path to websocket.
+type wsListener struct {
+	inner         net.Listener
+	server        *http.Server
+	securityLevel uint
+	ready         chan static.ConnResult
+	done          chan struct{}
+	err           error
+}
+
+func newWsListener(inner net.Listener, path string, securityLevel uint, headerTimeout time.Duration) *wsListener {
+	l := &wsListener{
+		inner:         inner,
+		securityLevel: securityLevel,
+		ready:         make(chan static.ConnResult),
+		done:          make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, websocket.Server{
+		Handshake: wsServerHandshake,
+		Handler:   l.handle,
+	})
+	l.server = &http.Server{Handler: mux, ReadHeaderTimeout: headerTimeout}
+	go l.serve()
+	return l
+}
+
+// Accepts only clients that speak yggdrasil subprotocol
+func wsServerHandshake(config *websocket.Config, req *http.Request) error {
+	for _, protocol := range config.Protocol {
+		if protocol == wsProtocol {
+			config.Protocol = []string{wsProtocol}
+			return nil
+		}
+	}
+	return fmt.Errorf("Client must speak the %s subprotocol", wsProtocol)
+}
+
+func (l *wsListener) serve() {
+	defer close(l.done)
+	l.err = l.server.Serve(l.inner)
+}
+
+// Passes connection to AcceptConn caller
+// and holds http handler until connection closed.
+func (l *wsListener) handle(ws *websocket.Conn) {
+	req := ws.Request()
+	localAddr, _ := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	remoteAddr, _ := net.ResolveTCPAddr(TcpScheme, req.RemoteAddr)
+	conn := newWsConn(ws, localAddr, remoteAddr)
+	select {
+	case l.ready <- static.ConnResult{Conn: conn, Pkey: nil, SecurityLevel: l.securityLevel}:
+		<-conn.closed
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptConn()
+	return conn.Conn, err
+}
+
+func (l *wsListener) AcceptConn() (static.ConnResult, error) {
+	select {
+	case conn := <-l.ready:
+		return conn, nil
+	case <-l.done:
+		return static.ConnResult{}, l.err
+	}
+}
+
+func (l *wsListener) Close() error {
+	return l.server.Close()
+}
+
+func (l *wsListener) Addr() net.Addr {
+	return l.inner.Addr()
+}
+
+// Implements ws yggdrasil transport
+// Compatible with the same named transport in yggdrasil-go
+//
+// Yggdrasil traffic is carried inside binary websocket frames.
+// Listener upgrades http requests on uri path ("/" by default).
+type WsTransport struct {
+	// Optional logger (nil means no logs)
+	Logger static.Logger
+	// Optional policy that remote addresses are checked with
+	Policy *static.Policy
+	// Dial options (uri params override them)
+	Config static.DialConfig
+}
+
+func (t WsTransport) GetScheme() string {
+	return WsScheme
+}
+
+func (t WsTransport) WithLogger(logger static.Logger) static.Transport {
+	t.Logger = logger
+	return t
+}
+
+func (t WsTransport) WithPolicy(policy *static.Policy) static.Transport {
+	t.Policy = policy
+	return t
+}
+
+func (t WsTransport) WithConfig(config static.DialConfig) static.Transport {
+	t.Config = config
+	return t
+}
+
+func (t WsTransport) Connect(ctx context.Context, uri url.URL, proxy *url.URL, key ed25519.PrivateKey) (static.ConnResult, error) {
+	return t.ConnectChain(ctx, uri, proxyChain(proxy), key)
+}
+
+func (t WsTransport) ConnectChain(ctx context.Context, uri url.URL, chain []*url.URL, key ed25519.PrivateKey) (static.ConnResult, error) {
+	conn, uri, err := wsDial(ctx, uri, chain, "80", dialers.TcpDialer{Logger: t.Logger, Policy: t.Policy}.WithConfig(t.Config))
+	if err != nil {
+		return static.ConnResult{}, err
+	}
+	ws, err := wsClientHandshake(ctx, conn, uri, "http://"+uri.Host)
+	if err != nil {
+		conn.Close()
+		return static.ConnResult{}, err
+	}
+	return static.ConnResult{
+		Conn:          ws,
+		Pkey:          nil,
+		SecurityLevel: static.SECURE_LVL_UNSECURE,
+	}, nil
+}
+
+func (t WsTransport) Listen(ctx context.Context, uri url.URL, key ed25519.PrivateKey) (static.TransportListener, error) {
+	headerTimeout, err := wsHeaderTimeout(uri)
+	if err != nil {
+		return nil, err
+	}
+	l, err := tcpListen(ctx, uri, t.Config)
+	if err != nil {
+		return nil, err
+	}
+	return newWsListener(l, wsPath(uri), static.SECURE_LVL_UNSECURE, headerTimeout), nil
+}
+
+// Implements wss yggdrasil transport
+// Compatible with the same named transport in yggdrasil-go
+//
+// It is the same as WsTransport but over tls.
+// Server certificates are verified with system roots by default.
+// Listener uses self-signed certificate generated from node key
+// if TLSConfig does not contain certificates.
+type WssTransport struct {
+	// Optional base tls config
+	TLSConfig *tls.Config
+	// Optional logger (nil means no logs)
+	Logger static.Logger
+	// Optional policy that remote addresses are checked with
+	Policy *static.Policy
+	// Dial options (uri params override them)
+	Config static.DialConfig
+}
+
+func (t WssTransport) GetScheme() string {
+	return WssScheme
+}
+
+func (t WssTransport) WithLogger(logger static.Logger) static.Transport {
+	t.Logger = logger
+	return t
+}
+
+func (t WssTransport) WithPolicy(policy *static.Policy) static.Transport {
+	t.Policy = policy
+	return t
+}
+
+func (t WssTransport) WithConfig(config static.DialConfig) static.Transport {
+	t.Config = config
+	return t
+}
+
+func (t WssTransport) Connect(ctx context.Context, uri url.URL, proxy *url.URL, key ed25519.PrivateKey) (static.ConnResult, error) {
+	return t.ConnectChain(ctx, uri, proxyChain(proxy), key)
+}
+
+func (t WssTransport) ConnectChain(ctx context.Context, uri url.URL, chain []*url.URL, key ed25519.PrivateKey) (static.ConnResult, error) {
+	conn, uri, err := wsDial(ctx, uri, chain, "443", dialers.TcpDialer{Logger: t.Logger, Policy: t.Policy}.WithConfig(t.Config))
+	if err != nil {
+		return static.ConnResult{}, err
+	}
+	config := &tls.Config{}
+	if t.TLSConfig != nil {
+		config = t.TLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = tlsServerName(uri)
+	}
+	tlsConn := tls.Client(conn, config)
+	if err = tlsHandshake(ctx, tlsConn); err != nil {
+		static.LoggerOrNop(t.Logger).Log(
+			static.LOG_LEVEL_DEBUG, "TLS handshake failed",
+			"uri", static.RedactUri(uri).String(), "err", err,
+		)
+		conn.Close()
+		return static.ConnResult{}, err
+	}
+	ws, err := wsClientHandshake(ctx, tlsConn, uri, "https://"+uri.Host)
+	if err != nil {
+		tlsConn.Close()
+		return static.ConnResult{}, err
+	}
+	return static.ConnResult{
+		Conn:          ws,
+		Pkey:          nil,
+		SecurityLevel: static.SECURE_LVL_ENCRYPTED,
+	}, nil
+}
+
+func (t WssTransport) Listen(ctx context.Context, uri url.URL, key ed25519.PrivateKey) (static.TransportListener, error) {
+	config := &tls.Config{}
+	if t.TLSConfig != nil {
+		config = t.TLSConfig.Clone()
+	}
+	if len(config.Certificates) == 0 && config.GetCertificate == nil {
+		cert, err := tlsCertificateFromKey(key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	headerTimeout, err := wsHeaderTimeout(uri)
+	if err != nil {
+		return nil, err
+	}
+	l, err := tcpListen(ctx, uri, t.Config)
+	if err != nil {
+		return nil, err
+	}
+	return newWsListener(tls.NewListener(l, config), wsPath(uri), static.SECURE_LVL_ENCRYPTED, headerTimeout), nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2022 DomesticMoth
+//
+// This file is part of Ytl.
+//
+// Ytl is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 3 of the License, or (at your option) any later version.
+//
+// Ytl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program; if not, write to the Free Software Foundation,
+// Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package transports
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"github.com/DomesticMoth/ytl/static"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func testWsTransportLoopback(t *testing.T, transport static.Transport, secureLvl uint) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	listenUri, _ := url.Parse(transport.GetScheme() + "://127.0.0.1:0/ygg")
+	listener, err := transport.Listen(context.Background(), *listenUri, key)
+	if err != nil {
+		t.Fatalf("Error while listening: %s", err)
+	}
+	defer listener.Close()
+	request := bytes.Repeat([]byte("request"), 10000)
+	response := []byte("response")
+	accepted := make(chan static.ConnResult, 1)
+	go func() {
+		conn, err := listener.AcceptConn()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+		buf := make([]byte, len(request))
+		if _, err := io.ReadFull(conn.Conn, buf); err == nil && bytes.Compare(buf, request) == 0 {
+			conn.Conn.Write(response)
+		}
+	}()
+	uri, _ := url.Parse(transport.GetScheme() + "://" + listener.Addr().String() + "/ygg")
+	client, err := transport.Connect(context.Background(), *uri, nil, key)
+	if err != nil {
+		t.Fatalf("Error while connecting: %s", err)
+	}
+	defer client.Conn.Close()
+	if client.SecurityLevel != secureLvl {
+		t.Errorf("Wrong client security lvl %d", client.SecurityLevel)
+	}
+	if _, ok := client.Conn.RemoteAddr().(*net.TCPAddr); !ok {
+		t.Errorf("Wrong client remote addr %s", client.Conn.RemoteAddr())
+	}
+	if _, err := client.Conn.Write(request); err != nil {
+		t.Fatalf("Error while writing: %s", err)
+	}
+	buf := make([]byte, len(response))
+	if _, err := io.ReadFull(client.Conn, buf); err != nil {
+		t.Fatalf("Error while reading: %s", err)
+	}
+	if bytes.Compare(buf, response) != 0 {
+		t.Errorf("Readed data is not eq to writed data")
+	}
+	server, ok := <-accepted
+	if !ok {
+		t.Fatalf("Connection was not accepted")
+	}
+	defer server.Conn.Close()
+	if server.SecurityLevel != secureLvl {
+		t.Errorf("Wrong server security lvl %d", server.SecurityLevel)
+	}
+	if _, ok := server.Conn.RemoteAddr().(*net.TCPAddr); !ok {
+		t.Errorf("Wrong server remote addr %s", server.Conn.RemoteAddr())
+	}
+}
+
+func TestWsTransportLoopback(t *testing.T) {
+	testWsTransportLoopback(t, WsTransport{}, static.SECURE_LVL_UNSECURE)
+}
+
+func TestWssTransportLoopback(t *testing.T) {
+	testWsTransportLoopback(
+		t,
+		WssTransport{TLSConfig: &tls.Config{InsecureSkipVerify: true}},
+		static.SECURE_LVL_ENCRYPTED,
+	)
+}
+
+func TestWsTransportWrongPath(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	transport := WsTransport{}
+	listenUri, _ := url.Parse("ws://127.0.0.1:0/ygg")
+	listener, err := transport.Listen(context.Background(), *listenUri, key)
+	if err != nil {
+		t.Fatalf("Error while listening: %s", err)
+	}
+	defer listener.Close()
+	uri, _ := url.Parse("ws://" + listener.Addr().String() + "/other")
+	if conn, err := transport.Connect(context.Background(), *uri, nil, key); err == nil {
+		conn.Conn.Close()
+		t.Errorf("Connecting to wrong path should cause an error")
+	}
+}
+
+func TestWsListenerHeaderTimeout(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	transport := WsTransport{}
+	listenUri, _ := url.Parse("ws://127.0.0.1:0/ygg?header_timeout=100ms")
+	listener, err := transport.Listen(context.Background(), *listenUri, key)
+	if err != nil {
+		t.Fatalf("Error while listening: %s", err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error while connecting: %s", err)
+	}
+	defer conn.Close()
+	// Headers are never finished
+	conn.Write([]byte("GET /ygg HTTP/1.1\r\nHost: x\r\n"))
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		t.Errorf("Slow client was not disconnected: %s", err)
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright 2022 DomesticMoth
+//
+// This file is part of Ytl.
+//
+// Ytl is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 3 of the License, or (at your option) any later version.
+//
+// Ytl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program; if not, write to the Free Software Foundation,
+// Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package ytl
+
+import (
+	"context"
+	"github.com/DomesticMoth/ytl/static"
+	"net"
+	"time"
+)
+
+// Default limits of ValidatingListener
+const (
+	DEFAULT_HANDSHAKE_WORKERS             = 64
+	DEFAULT_MAX_PENDING_HANDSHAKES        = 1024
+	DEFAULT_MAX_PENDING_HANDSHAKES_PER_IP = 16
+	// Pending handshakes hold limited slots,
+	// so they time out faster than in YggListener.
+	DEFAULT_VALIDATING_HANDSHAKE_TIMEOUT = 10 * time.Second
+)
+
+// Limits of ValidatingListener.
+// Zero values mean defaults.
+type ValidatingListenerOptions struct {
+	// Max count of connections that receive handshake package concurrently.
+	// Other pending connections wait for free worker,
+	// time of waiting is counted in HandshakeTimeout.
+	Workers int
+	// Max count of accepted connections
+	// that are in handshake or are waiting for Accept call.
+	// New connections over the limit are closed immediately.
+	MaxPending int
+	// The same as MaxPending but for single source ip
+	MaxPendingPerIp int
+	// Timeout of receiving handshake package.
+	// It is used if YggListener has no timeout set
+	// with ConnManager config or uri param.
+	HandshakeTimeout time.Duration
+}
+
+func (o ValidatingListenerOptions) withDefaults() ValidatingListenerOptions {
+	if o.Workers <= 0 {
+		o.Workers = DEFAULT_HANDSHAKE_WORKERS
+	}
+	if o.MaxPending <= 0 {
+		o.MaxPending = DEFAULT_MAX_PENDING_HANDSHAKES
+	}
+	if o.MaxPendingPerIp <= 0 {
+		o.MaxPendingPerIp = DEFAULT_MAX_PENDING_HANDSHAKES_PER_IP
+	}
+	if o.HandshakeTimeout <= 0 {
+		o.HandshakeTimeout = DEFAULT_VALIDATING_HANDSHAKE_TIMEOUT
+	}
+	return o
+}
+
+type pendingConn struct {
+	conn *YggConn
+	ip   string
+}
+
+// Listener that yields only connections which handshake
+// passed transport key, AllowList and deduplication checks.
+//
+// Handshake is started as soon as connection is accepted,
+// but only limited count of handshake packages is read concurrently.
+// Count of pending handshakes is limited in total and per source ip.
+//
+// It implements [net.Listener],
+// so it can be passed to existing servers.
+type ValidatingListener struct {
+	listener  *YggListener
+	options   ValidatingListenerOptions
+	ctx       context.Context
+	cancel    context.CancelFunc
+	lockChan  chan struct{}
+	pending   map[*YggConn]string
+	pendingIp map[string]int
+	// Semaphore of handshake workers
+	slots chan struct{}
+	// Validated connections waiting for Accept call
+	ready chan pendingConn
+	done  chan struct{}
+	err   error
+}
+
+// Creates ValidatingListener over YggListener
+// and starts accepting connections.
+func NewValidatingListener(listener *YggListener, options ValidatingListenerOptions) *ValidatingListener {
+	options = options.withDefaults()
+	ctx, cancel := context.WithCancel(context.Background())
+	lock := make(chan struct{}, 1)
+	lock <- struct{}{}
+	l := &ValidatingListener{
+		listener,
+		options,
+		ctx,
+		cancel,
+		lock,
+		make(map[*YggConn]string),
+		make(map[string]int),
+		make(chan struct{}, options.Workers),
+		make(chan pendingConn, options.MaxPending),
+		make(chan struct{}),
+		nil,
+	}
+	go l.acceptLoop()
+	return l
+}
+
+// Returns ip of remote side or whole address if it has no port
+func remoteIp(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Checks limits of pending handshakes for ip.
+// Lock must be held.
+func (l *ValidatingListener) checkLimits(ip string) error {
+	if len(l.pending) >= l.options.MaxPending {
+		return static.TooManyHandshakesError{}
+	}
+	if l.pendingIp[ip] >= l.options.MaxPendingPerIp {
+		return static.TooManyHandshakesError{Addr: ip}
+	}
+	return nil
+}
+
+// Reserves place for pending handshake.
+// Limits must be checked before.
+func (l *ValidatingListener) reserve(conn *YggConn, ip string) {
+	<-l.lockChan
+	defer func() { l.lockChan <- struct{}{} }()
+	l.pending[conn] = ip
+	l.pendingIp[ip] += 1
+}
+
+// Frees place of connection that was rejected or accepted.
+// Returns false if connection was already closed by Close.
+func (l *ValidatingListener) release(pending pendingConn) bool {
+	<-l.lockChan
+	defer func() { l.lockChan <- struct{}{} }()
+	if _, ok := l.pending[pending.conn]; !ok {
+		return false
+	}
+	delete(l.pending, pending.conn)
+	if l.pendingIp[pending.ip] -= 1; l.pendingIp[pending.ip] <= 0 {
+		delete(l.pendingIp, pending.ip)
+	}
+	return true
+}
+
+// Returns handshake timeout for accepted connections
+func (l *ValidatingListener) handshakeTimeout() time.Duration {
+	if l.listener.handshakeTimeout > 0 {
+		return l.listener.handshakeTimeout
+	}
+	return l.options.HandshakeTimeout
+}
+
+func (l *ValidatingListener) acceptLoop() {
+	defer close(l.done)
+	for {
+		conn, err := l.listener.inner_listener.AcceptConn()
+		if err != nil {
+			l.err = err
+			return
+		}
+		if l.ctx.Err() != nil {
+			conn.Conn.Close()
+			l.err = net.ErrClosed
+			return
+		}
+		if err := l.listener.checkPolicy(conn); err != nil {
+			l.listener.reject(conn, err)
+			continue
+		}
+		ip := remoteIp(conn.Conn.RemoteAddr())
+		<-l.lockChan
+		err = l.checkLimits(ip)
+		l.lockChan <- struct{}{}
+		if err != nil {
+			l.listener.reject(conn, err)
+			continue
+		}
+		// Handshake is started by wrap
+		ygg, err := l.listener.wrap(conn, l.handshakeTimeout(), l.slots)
+		if err != nil {
+			continue
+		}
+		// Only acceptLoop reserves places, so limits are not changed since check
+		l.reserve(ygg, ip)
+		ygg.addHandshakeHook(func() {
+			l.finish(pendingConn{ygg, ip})
+		})
+	}
+}
+
+// Passes connection which handshake is finished to Accept
+// or closes it if handshake failed.
+func (l *ValidatingListener) finish(pending pendingConn) {
+	// Handshake is finished, so it does not block
+	if err := pending.conn.Handshake(context.Background()); err != nil {
+		pending.conn.Close()
+		l.release(pending)
+		return
+	}
+	// Capacity of ready equals to MaxPending
+	// and place is released only by Accept, so it never blocks
+	l.ready <- pending
+}
+
+// AcceptYgg waits for and returns the next connection
+// that passed handshake checks.
+func (l *ValidatingListener) AcceptYgg() (*YggConn, error) {
+	for {
+		select {
+		case pending := <-l.ready:
+			// Connection may be already closed by Close
+			if l.release(pending) {
+				return pending.conn, nil
+			}
+		case <-l.done:
+			// Connections validated before listener was closed
+			select {
+			case pending := <-l.ready:
+				if l.release(pending) {
+					return pending.conn, nil
+				}
+			default:
+				return nil, l.err
+			}
+		}
+	}
+}
+
+// Accept waits for and returns the next connection
+// that passed handshake checks.
+func (l *ValidatingListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptYgg()
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Close closes the listener and all connections
+// which handshakes are not finished yet.
+// Any blocked Accept operations will be unblocked and return errors.
+func (l *ValidatingListener) Close() error {
+	l.cancel()
+	err := l.listener.Close()
+	<-l.done
+	// Close connections that were not taken by Accept
+	<-l.lockChan
+	pending := l.pending
+	l.pending = make(map[*YggConn]string)
+	l.pendingIp = make(map[string]int)
+	l.lockChan <- struct{}{}
+	for conn := range pending {
+		conn.Close()
+	}
+	return err
+}
+
+// Addr returns the listener's network address.
+func (l *ValidatingListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
@@ -0,0 +1,235 @@
+// Copyright 2022 DomesticMoth
+//
+// This file is part of Ytl.
+//
+// Ytl is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 3 of the License, or (at your option) any later version.
+//
+// Ytl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program; if not, write to the Free Software Foundation,
+// Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package ytl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/DomesticMoth/ytl/debugstuff"
+	"github.com/DomesticMoth/ytl/static"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newTestValidatingListener(t *testing.T, options ValidatingListenerOptions) (*ValidatingListener, *ConnManager) {
+	manager := NewConnManager(context.Background(), nil, nil, nil, nil)
+	uri, _ := url.Parse("tcp://127.0.0.1:0")
+	listener, err := manager.Listen(*uri)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return NewValidatingListener(&listener, options), manager
+}
+
+type acceptResult struct {
+	conn *YggConn
+	err  error
+}
+
+// Accepts connections in background until listener is closed
+func acceptInBackground(l *ValidatingListener) chan acceptResult {
+	results := make(chan acceptResult, 16)
+	go func() {
+		for {
+			conn, err := l.AcceptYgg()
+			results <- acceptResult{conn, err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return results
+}
+
+func waitAccept(results chan acceptResult, timeout time.Duration) (*YggConn, error) {
+	select {
+	case r := <-results:
+		return r.conn, r.err
+	case <-time.After(timeout):
+		return nil, static.ConnTimeoutError{}
+	}
+}
+
+func TestValidatingListener(t *testing.T) {
+	var listener net.Listener
+	l, manager := newTestValidatingListener(t, ValidatingListenerOptions{})
+	defer manager.Close()
+	listener = l
+	defer listener.Close()
+	results := acceptInBackground(l)
+	// Client with invalid handshake is not yielded
+	bad, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer bad.Close()
+	bad.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	if _, err := waitAccept(results, time.Millisecond*200); err != (static.ConnTimeoutError{}) {
+		t.Errorf("Connection with invalid handshake was accepted")
+	}
+	good, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer good.Close()
+	good.Write(debugstuff.MockConnContent())
+	conn, err := waitAccept(results, time.Second*5)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	if !state.HandshakeComplete || bytes.Compare(state.PeerKey, debugstuff.MockPubKey()) != 0 {
+		t.Errorf("Connection is not validated %v", state)
+	}
+}
+
+func TestValidatingListenerPerIpLimit(t *testing.T) {
+	l, manager := newTestValidatingListener(t, ValidatingListenerOptions{MaxPendingPerIp: 1})
+	defer manager.Close()
+	defer l.Close()
+	results := acceptInBackground(l)
+	first, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer first.Close()
+	// Wait until first connection is accepted
+	time.Sleep(time.Millisecond * 100)
+	second, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Connection over limit was not closed: %s", err)
+	}
+	first.Write(debugstuff.MockConnContent())
+	conn, err := waitAccept(results, time.Second*5)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	conn.Close()
+}
+
+func TestValidatingListenerClose(t *testing.T) {
+	l, manager := newTestValidatingListener(t, ValidatingListenerOptions{})
+	defer manager.Close()
+	pending, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer pending.Close()
+	time.Sleep(time.Millisecond * 100)
+	results := acceptInBackground(l)
+	l.Close()
+	if _, err := waitAccept(results, time.Second*5); err == nil || err == (static.ConnTimeoutError{}) {
+		t.Errorf("Accept on closed listener must return error: %v", err)
+	}
+	pending.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := pending.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Pending connection was not closed: %s", err)
+	}
+}
+
+func TestValidatingListenerPolicy(t *testing.T) {
+	manager := NewConnManager(context.Background(), nil, nil, nil, nil)
+	defer manager.Close()
+	nets, _ := static.ParseCIDRs("127.0.0.0/8")
+	manager.SetPolicy(&static.Policy{DenyNets: nets})
+	observer := rejectObserver{reasons: make(chan error, 1)}
+	manager.AddObserver(observer)
+	uri, _ := url.Parse("tcp://127.0.0.1:0")
+	listener, err := manager.Listen(*uri)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	l := NewValidatingListener(&listener, ValidatingListenerOptions{})
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Connection from denied address was not closed: %s", err)
+	}
+	select {
+	case reason := <-observer.reasons:
+		if !errors.Is(reason, static.ErrUnacceptableAddress) {
+			t.Errorf("Wrong reject reason %s", reason)
+		}
+	case <-time.After(time.Second * 5):
+		t.Errorf("Reject event was not received")
+	}
+}
+
+func TestValidatingListenerWorkers(t *testing.T) {
+	l, manager := newTestValidatingListener(
+		t, ValidatingListenerOptions{Workers: 1, HandshakeTimeout: time.Millisecond * 500},
+	)
+	defer manager.Close()
+	defer l.Close()
+	results := acceptInBackground(l)
+	// Silent connection holds the only worker until handshake timeout
+	silent, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer silent.Close()
+	time.Sleep(time.Millisecond * 200)
+	good, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer good.Close()
+	good.Write(debugstuff.MockConnContent())
+	if _, err := waitAccept(results, time.Millisecond*200); err != (static.ConnTimeoutError{}) {
+		t.Errorf("Handshake was read over workers limit")
+	}
+	conn, err := waitAccept(results, time.Second*2)
+	if err != nil {
+		t.Fatalf("Connection was not accepted after worker was freed: %s", err)
+	}
+	conn.Close()
+}
+
+func TestValidatingListenerHandshakeTimeout(t *testing.T) {
+	l, manager := newTestValidatingListener(
+		t, ValidatingListenerOptions{HandshakeTimeout: time.Millisecond * 100},
+	)
+	defer manager.Close()
+	defer l.Close()
+	silent, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer silent.Close()
+	silent.SetReadDeadline(time.Now().Add(time.Second * 5))
+	// Local handshake package is sent before connection is closed
+	if _, err := io.Copy(io.Discard, silent); err != nil {
+		t.Errorf("Silent connection was not closed by handshake timeout: %s", err)
+	}
+}
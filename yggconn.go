@@ -20,30 +20,70 @@ package ytl
 
 import (
 	"bytes"
+	"context"
 	"crypto/ed25519"
+	"encoding/binary"
 	"github.com/DomesticMoth/ytl/addr"
 	"github.com/DomesticMoth/ytl/static"
+	"golang.org/x/crypto/blake2b"
 	"io"
 	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// Parse handshake package with meta info.
-// Returns parsed data, or error.
-func internalParseMetaPackage(conn net.Conn) (
+// Size of pooled buffers for reading handshake packages.
+// Both v0.4 and typical v0.5 packages fit into it.
+const metaBufferSize = 256
+
+// Buffers reused between handshakes,
+// so pending handshakes do not allocate
+// until the whole package is received.
+var metaBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, metaBufferSize)
+		return &buf
+	},
+}
+
+// Returns slice of scratch buffer with passed size
+// or new slice if scratch is too small.
+func metaScratch(scratch []byte, size int) []byte {
+	if cap(scratch) >= size {
+		return scratch[:size]
+	}
+	return make([]byte, size)
+}
+
+// Checks if handshake package is TLV based (v0.5) by two bytes after header.
+//
+// In v0.4 package they contain protocol version (major is always 0),
+// in v0.5 package they contain length of the rest of package
+// that can not be less than signature size.
+func isTlvMetaPackage(b []byte) bool {
+	return b[0] == 0 && int(binary.BigEndian.Uint16(b)) >= ed25519.SignatureSize
+}
+
+// Parse v0.4 handshake package.
+// Header with version is already readed to buf.
+// Package is read to scratch buffer if it fits.
+//
+// v0.4 package can not carry password,
+// so it is rejected if password is required.
+func parseLegacyMetaPackage(conn net.Conn, head []byte, password []byte, scratch []byte) (
 	err error,
 	version *static.ProtoVersion,
 	pkey ed25519.PublicKey,
+	priority uint8,
 	buf []byte,
 ) {
-	buf = make([]byte, len(static.META_HEADER())+2+ed25519.PublicKeySize)
-	_, err = io.ReadFull(conn, buf)
+	buf = metaScratch(scratch, len(head)+ed25519.PublicKeySize)
+	copy(buf, head)
+	_, err = io.ReadFull(conn, buf[len(head):])
 	if err != nil {
-		return
-	}
-	if bytes.Compare(static.META_HEADER(), buf[:len(static.META_HEADER())]) != 0 {
-		// Unknown proto
-		err = static.UnknownProtoError{}
+		buf = nil
 		return
 	}
 	version = &static.ProtoVersion{
@@ -59,64 +99,318 @@ func internalParseMetaPackage(conn net.Conn) (
 		}
 		return
 	}
+	if len(password) > 0 {
+		err = static.InvalidPasswordError{}
+		return
+	}
 	key_raw := buf[len(buf)-ed25519.PublicKeySize:]
 	pkey = make(ed25519.PublicKey, ed25519.PublicKeySize)
 	copy(pkey, key_raw)
 	return
 }
 
+// Parse v0.5 TLV based handshake package and verify its signature.
+// Header with length is already readed to buf.
+// Package is read to scratch buffer if it fits.
+//
+// Signature is made over BLAKE2b hash of public key
+// keyed with password (may be empty).
+func parseTlvMetaPackage(conn net.Conn, head []byte, password []byte, scratch []byte) (
+	err error,
+	version *static.ProtoVersion,
+	pkey ed25519.PublicKey,
+	priority uint8,
+	buf []byte,
+) {
+	length := int(binary.BigEndian.Uint16(head[len(static.META_HEADER()):]))
+	// Length is declared by peer, so it is checked before allocating
+	if len(head)+length > metaBufferSize {
+		err = static.InvalidMetaPackageError{
+			Text: "Handshake package is too long",
+		}
+		return
+	}
+	buf = metaScratch(scratch, len(head)+length)
+	copy(buf, head)
+	_, err = io.ReadFull(conn, buf[len(head):])
+	if err != nil {
+		buf = nil
+		return
+	}
+	fields := buf[len(head) : len(buf)-ed25519.SignatureSize]
+	sig := buf[len(buf)-ed25519.SignatureSize:]
+	var major, minor uint16
+	var key_raw []byte
+	for len(fields) >= 4 {
+		op := binary.BigEndian.Uint16(fields[:2])
+		oplen := int(binary.BigEndian.Uint16(fields[2:4]))
+		if fields = fields[4:]; len(fields) < oplen {
+			break
+		}
+		value := fields[:oplen]
+		switch {
+		case op == static.META_VERSION_MAJOR && oplen == 2:
+			major = binary.BigEndian.Uint16(value)
+		case op == static.META_VERSION_MINOR && oplen == 2:
+			minor = binary.BigEndian.Uint16(value)
+		case op == static.META_PUBLIC_KEY && oplen == ed25519.PublicKeySize:
+			key_raw = value
+		case op == static.META_PRIORITY && oplen == 1:
+			priority = value[0]
+		}
+		fields = fields[oplen:]
+	}
+	version = &static.ProtoVersion{Major: uint8(major), Minor: uint8(minor)}
+	target_version := static.PROTO_VERSION_0_5()
+	if major != uint16(target_version.Major) || minor != uint16(target_version.Minor) {
+		// Unknown proto version
+		err = static.UnknownProtoVersionError{
+			Expected: target_version,
+			Received: *version,
+		}
+		return
+	}
+	if key_raw == nil {
+		err = static.InvalidMetaPackageError{
+			Text: "Handshake package does not contain public key",
+		}
+		return
+	}
+	hash, err := metaPackageHash(key_raw, password)
+	if err != nil {
+		return
+	}
+	if !ed25519.Verify(key_raw, hash, sig) {
+		if len(password) > 0 {
+			err = static.InvalidPasswordError{}
+		} else {
+			err = static.InvalidSignatureError{}
+		}
+		return
+	}
+	pkey = make(ed25519.PublicKey, ed25519.PublicKeySize)
+	copy(pkey, key_raw)
+	return
+}
+
+// Returns BLAKE2b hash of public key keyed with password.
+// It is signed in v0.5 handshake package.
+func metaPackageHash(pkey ed25519.PublicKey, password []byte) ([]byte, error) {
+	if len(password) > blake2b.Size {
+		return nil, static.InvalidPasswordError{}
+	}
+	hasher, err := blake2b.New512(password)
+	if err != nil {
+		return nil, err
+	}
+	hasher.Write(pkey)
+	return hasher.Sum(nil), nil
+}
+
+// Parse handshake package with meta info.
+// Both v0.4 and v0.5 packages are supported.
+// Returns parsed data, or error.
+//
+// Returned buf is always a new slice
+// and does not share memory with pooled buffers.
+func internalParseMetaPackage(conn net.Conn, password []byte) (
+	err error,
+	version *static.ProtoVersion,
+	pkey ed25519.PublicKey,
+	priority uint8,
+	buf []byte,
+) {
+	head := make([]byte, len(static.META_HEADER())+2)
+	_, err = io.ReadFull(conn, head)
+	if err != nil {
+		return
+	}
+	if bytes.Compare(static.META_HEADER(), head[:len(static.META_HEADER())]) != 0 {
+		// Unknown proto
+		err = static.UnknownProtoError{}
+		buf = head
+		return
+	}
+	// Scratch buffer is taken only after header is received,
+	// so silent connections hold nothing but the header.
+	scratch := metaBufferPool.Get().(*[]byte)
+	defer metaBufferPool.Put(scratch)
+	if isTlvMetaPackage(head[len(static.META_HEADER()):]) {
+		err, version, pkey, priority, buf = parseTlvMetaPackage(conn, head, password, *scratch)
+	} else {
+		err, version, pkey, priority, buf = parseLegacyMetaPackage(conn, head, password, *scratch)
+	}
+	if buf != nil {
+		buf = append([]byte(nil), buf...)
+	}
+	return
+}
+
+// Checks if error is caused by expired deadline
+func isTimeoutError(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
 // Parse handshake package with meta info.
 // Returns parsed data, or error.
 // Close connection if handshake package
 // does not received until timeout.
-func parseMetaPackage(conn net.Conn, timeout time.Duration) (
+//
+// Timeout is implemented with read deadline,
+// so no extra goroutine is started.
+// Connections without deadlines support
+// are closed by timer instead.
+//
+// Read deadline of conn is cleared on return,
+// the caller is responsible for restoring previous one.
+func parseMetaPackage(conn net.Conn, timeout time.Duration, password []byte) (
 	err error,
 	version *static.ProtoVersion,
 	pkey ed25519.PublicKey,
+	priority uint8,
 	buf []byte,
 ) {
-	type result struct {
-		err     error
-		version *static.ProtoVersion
-		pkey    ed25519.PublicKey
-		buf     []byte
-	}
-	ret := make(chan result, 1)
-	go func() {
-		err, version, pkey, buf := internalParseMetaPackage(conn)
-		ret <- result{err, version, pkey, buf}
-	}()
-	select {
-	case <-time.After(timeout):
+	var expired uint32 = 0
+	if conn.SetReadDeadline(time.Now().Add(timeout)) == nil {
+		defer conn.SetReadDeadline(time.Time{})
+	} else {
+		timer := time.AfterFunc(timeout, func() {
+			atomic.StoreUint32(&expired, 1)
+			conn.Close()
+		})
+		defer timer.Stop()
+	}
+	err, version, pkey, priority, buf = internalParseMetaPackage(conn, password)
+	if err != nil && (isTimeoutError(err) || atomic.LoadUint32(&expired) == 1) {
 		conn.Close()
 		err = static.ConnTimeoutError{}
-		return
-	case ret := <-ret:
-		err = ret.err
-		version = ret.version
-		pkey = ret.pkey
-		buf = ret.buf
-		return
+		version = nil
+		pkey = nil
+		buf = nil
 	}
+	return
 }
 
+// Builds handshake package with meta info
+// for passed protocol version signed by key.
+// Password is used only by v0.5 handshake.
+func encodeMetaPackage(key ed25519.PrivateKey, version static.ProtoVersion, priority uint8, password []byte) ([]byte, error) {
+	pub := key.Public().(ed25519.PublicKey)
+	buf := append([]byte{}, static.META_HEADER()...)
+	switch version {
+	case static.PROTO_VERSION():
+		if len(password) > 0 {
+			return nil, static.InvalidPasswordError{}
+		}
+		buf = append(buf, version.Major, version.Minor)
+		buf = append(buf, pub...)
+		return buf, nil
+	case static.PROTO_VERSION_0_5():
+		buf = append(buf, 0, 0) // Length of the rest of package
+		field := func(op uint16, value []byte) {
+			buf = append(buf, 0, 0, 0, 0)
+			binary.BigEndian.PutUint16(buf[len(buf)-4:], op)
+			binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(len(value)))
+			buf = append(buf, value...)
+		}
+		field(static.META_VERSION_MAJOR, []byte{0, version.Major})
+		field(static.META_VERSION_MINOR, []byte{0, version.Minor})
+		field(static.META_PUBLIC_KEY, pub)
+		field(static.META_PRIORITY, []byte{priority})
+		hash, err := metaPackageHash(pub, password)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, ed25519.Sign(key, hash)...)
+		binary.BigEndian.PutUint16(buf[len(static.META_HEADER()):], uint16(len(buf)-len(static.META_HEADER())-2))
+		return buf, nil
+	}
+	return nil, static.UnknownProtoVersionError{
+		Expected: static.PROTO_VERSION(),
+		Received: version,
+	}
+}
+
+// Default timeout of receiving handshake package
+const DEFAULT_HANDSHAKE_TIMEOUT = time.Minute
+
 // Wraper that represents connection with
 // other yggdrasil node.
 //
 // Incapsulate analysing handshake pkg
 // and communicate with DeduplicationManager.
 type YggConn struct {
+	// Accessed atomically, must be 64-bit aligned
+	bytesRead        uint64
+	bytesWritten     uint64
 	innerConn        net.Conn
 	transport_key    ed25519.PublicKey
-	allowList        *static.AllowList
+	allowList        static.KeyFilter
 	secureTranport   uint
 	extraReadBuffChn chan []byte
 	err              error
 	dm               *DeduplicationManager
-	closefn          func()
+	closeHooks       []func()
 	pVersion         chan *static.ProtoVersion
 	otherPublicKey   chan ed25519.PublicKey
+	priority         uint8
 	isClosed         chan bool
+	handshakeSent    chan struct{}
+	password         []byte
+	done             chan struct{}
+	stateLock        chan struct{}
+	peerVersion      *static.ProtoVersion
+	peerKey          ed25519.PublicKey
+	handshakeDone    chan struct{}
+	observer         ConnObserver
+	uri              url.URL
+	direction        ConnDirection
+	started          time.Time
+	logger           static.Logger
+	handshakeTimeout time.Duration
+	// Guarded by stateLock
+	handshakeErr      error
+	handshakeDuration time.Duration
+	policy            *static.Policy
+	// Read deadline set by user, guarded by stateLock.
+	// Until handshake package is received it is only recorded,
+	// so handshake timeout can not be turned off by user.
+	readDeadline time.Time
+	// True if handshake package is read, guarded by stateLock
+	handshakeRead bool
+	// Called once when handshake is finished, guarded by stateLock
+	handshakeHooks []func()
+	handshakeSlots chan struct{}
+}
+
+// Extra options of YggConn
+type YggConnOptions struct {
+	// Private key used to sign local handshake package
+	Key ed25519.PrivateKey
+	// Protocol version of local handshake package.
+	// If it is nil, local handshake package is not sent.
+	HandshakeVersion *static.ProtoVersion
+	// Password that handshake packages are signed with (v0.5 only).
+	// Handshakes with missing or wrong password are rejected.
+	Password []byte
+	// Receives handshake, reject and close events of connection
+	Observer ConnObserver
+	// Uri and direction passed to Observer in events
+	Uri       url.URL
+	Direction ConnDirection
+	// Optional logger (nil means no logs)
+	Logger static.Logger
+	// Timeout of receiving handshake package.
+	// If it is zero, DEFAULT_HANDSHAKE_TIMEOUT is used.
+	HandshakeTimeout time.Duration
+	// Optional policy that peer key is checked with
+	Policy *static.Policy
+	// Optional filter of allowed keys used instead of allow list param
+	// (as example static.IndexedAllowList)
+	AllowKeys static.KeyFilter
+	// Optional semaphore that limits count of concurrent handshake reads
+	handshakeSlots chan struct{}
 }
 
 // Wraps regular net connection to YggConn.
@@ -130,71 +424,276 @@ type YggConn struct {
 // it will be closed.
 // Otherwise, it will be available as a normal connection.
 func ConnToYggConn(conn net.Conn, transport_key ed25519.PublicKey, allow *static.AllowList, secureTranport uint, dm *DeduplicationManager) *YggConn {
+	ret, _ := ConnToYggConnWithOptions(conn, transport_key, allow, secureTranport, dm, YggConnOptions{})
+	return ret
+}
+
+// Wraps regular net connection to YggConn
+// and sends local handshake package to connected node.
+//
+// Handshake package is built for passed protocol version
+// and signed by passed private key.
+// Data passed to Write is sent only after handshake package.
+//
+// Other params are the same as in ConnToYggConn.
+func ConnToYggConnWithHandshake(
+	conn net.Conn,
+	transport_key ed25519.PublicKey,
+	allow *static.AllowList,
+	secureTranport uint,
+	dm *DeduplicationManager,
+	key ed25519.PrivateKey,
+	version static.ProtoVersion,
+) (*YggConn, error) {
+	return ConnToYggConnWithOptions(conn, transport_key, allow, secureTranport, dm, YggConnOptions{
+		Key:              key,
+		HandshakeVersion: &version,
+	})
+}
+
+// Wraps regular net connection to YggConn with extra options.
+//
+// Other params are the same as in ConnToYggConn.
+func ConnToYggConnWithOptions(
+	conn net.Conn,
+	transport_key ed25519.PublicKey,
+	allow *static.AllowList,
+	secureTranport uint,
+	dm *DeduplicationManager,
+	options YggConnOptions,
+) (*YggConn, error) {
 	if conn == nil {
-		return nil
+		return nil, nil
+	}
+	var meta []byte = nil
+	if options.HandshakeVersion != nil {
+		var err error
+		meta, err = encodeMetaPackage(
+			KeyFromOptionalKey(options.Key),
+			*options.HandshakeVersion,
+			0,
+			options.Password,
+		)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	handshakeTimeout := options.HandshakeTimeout
+	if handshakeTimeout <= 0 {
+		handshakeTimeout = DEFAULT_HANDSHAKE_TIMEOUT
+	}
+	var allowList static.KeyFilter = nil
+	if allow != nil {
+		allowList = allow
+	}
+	if options.AllowKeys != nil {
+		allowList = options.AllowKeys
 	}
 	isClosed := make(chan bool, 1)
 	isClosed <- false
+	stateLock := make(chan struct{}, 1)
+	stateLock <- struct{}{}
 	ret := YggConn{
+		0,
+		0,
 		conn,
 		transport_key,
-		allow,
+		allowList,
 		secureTranport,
 		make(chan []byte, 1),
 		nil,
 		dm,
-		func() {},
+		nil,
 		make(chan *static.ProtoVersion, 1),
 		make(chan ed25519.PublicKey, 1),
+		0,
 		isClosed,
+		make(chan struct{}),
+		options.Password,
+		make(chan struct{}),
+		stateLock,
+		nil,
+		nil,
+		make(chan struct{}),
+		options.Observer,
+		options.Uri,
+		options.Direction,
+		time.Now(),
+		static.LoggerOrNop(options.Logger),
+		handshakeTimeout,
+		nil,
+		0,
+		options.Policy,
+		time.Time{},
+		false,
+		nil,
+		options.handshakeSlots,
+	}
+	if meta != nil {
+		go ret.sendHandshake(meta)
+	} else {
+		close(ret.handshakeSent)
 	}
 	go ret.middleware()
-	return &ret
+	return &ret, nil
+}
+
+// Writes local handshake package before any other data
+func (y *YggConn) sendHandshake(meta []byte) {
+	defer close(y.handshakeSent)
+	if _, err := y.innerConn.Write(meta); err != nil {
+		y.setErr(err)
+	}
 }
 
 func (y *YggConn) setErr(err error) {
+	<-y.stateLock
 	if y.err == nil {
 		y.err = err
 	}
+	y.stateLock <- struct{}{}
 	y.Close()
 }
 
+// Returns error that connection was closed with (if any)
+func (y *YggConn) getErr() error {
+	<-y.stateLock
+	defer func() { y.stateLock <- struct{}{} }()
+	return y.err
+}
+
+// Builds observer event from current connection state
+func (y *YggConn) event(err error) ConnEvent {
+	key, version := y.peerInfo()
+	return ConnEvent{
+		Uri:           *static.RedactUri(y.uri),
+		RemoteAddr:    y.innerConn.RemoteAddr(),
+		PublicKey:     key,
+		Version:       version,
+		SecurityLevel: y.secureTranport,
+		Direction:     y.direction,
+		Duration:      time.Since(y.started),
+		BytesRead:     atomic.LoadUint64(&y.bytesRead),
+		BytesWritten:  atomic.LoadUint64(&y.bytesWritten),
+		Err:           err,
+	}
+}
+
+// Notifies observer about rejected connection and closes it.
+// Connections that are already closed by caller are not reported.
+func (y *YggConn) reject(err error) {
+	<-y.stateLock
+	y.handshakeErr = err
+	y.stateLock <- struct{}{}
+	select {
+	case <-y.done:
+	default:
+		event := y.event(err)
+		y.logger.Log(
+			static.LOG_LEVEL_INFO, "Connection rejected",
+			"uri", event.Uri.String(), "remote", event.RemoteAddr,
+			"key", event.PublicKey, "security", event.SecurityLevel, "reason", err,
+		)
+		if y.observer != nil {
+			y.observer.OnReject(event, err)
+		}
+	}
+	y.setErr(err)
+}
+
 func (y *YggConn) checkAddr() bool {
 	laddr, _, _ := net.SplitHostPort(y.innerConn.LocalAddr().String())
 	raddr, _, _ := net.SplitHostPort(y.innerConn.RemoteAddr().String())
 	if err := addr.CheckAddr(net.ParseIP(laddr)); err != nil {
-		y.setErr(err)
+		y.reject(err)
 		return true
 	}
 	if err := addr.CheckAddr(net.ParseIP(raddr)); err != nil {
-		y.setErr(err)
+		y.reject(err)
 		return true
 	}
 	return false
 }
 
+// Waits for free slot if count of concurrent handshakes is limited.
+// Time of waiting is counted in handshake timeout,
+// so the rest of it is returned.
+func (y *YggConn) acquireHandshakeSlot() (time.Duration, error) {
+	if y.handshakeSlots == nil {
+		return y.handshakeTimeout, nil
+	}
+	timer := time.NewTimer(y.handshakeTimeout)
+	defer timer.Stop()
+	select {
+	case y.handshakeSlots <- struct{}{}:
+		return y.handshakeTimeout - time.Since(y.started), nil
+	case <-timer.C:
+		return 0, static.ConnTimeoutError{}
+	case <-y.done:
+		return 0, net.ErrClosed
+	}
+}
+
 func (y *YggConn) middleware() {
 	var extraReadBuff []byte = nil
+	defer func() {
+		<-y.stateLock
+		close(y.handshakeDone)
+		hooks := y.handshakeHooks
+		y.handshakeHooks = nil
+		y.stateLock <- struct{}{}
+		for _, hook := range hooks {
+			hook()
+		}
+	}()
+	defer func() {
+		<-y.stateLock
+		y.handshakeDuration = time.Since(y.started)
+		y.stateLock <- struct{}{}
+	}()
 	defer func() { y.extraReadBuffChn <- extraReadBuff }()
 	// We must do this in middleware and not in constructor because it may spend much time
 	if y.checkAddr() {
+		y.pVersion <- nil
+		y.otherPublicKey <- nil
+		return
+	}
+	timeout, err := y.acquireHandshakeSlot()
+	if err != nil {
+		y.pVersion <- nil
+		y.otherPublicKey <- nil
+		y.reject(err)
 		return
 	}
-	err, version, pkey, buf := parseMetaPackage(y.innerConn, time.Minute)
+	err, version, pkey, priority, buf := parseMetaPackage(y.innerConn, timeout, y.password)
+	if y.handshakeSlots != nil {
+		<-y.handshakeSlots
+	}
+	y.priority = priority
+	<-y.stateLock
+	y.peerVersion = version
+	y.peerKey = pkey
+	// Apply deadline set by user while handshake was pending
+	if !y.readDeadline.IsZero() {
+		y.innerConn.SetReadDeadline(y.readDeadline)
+	}
+	y.handshakeRead = true
+	y.stateLock <- struct{}{}
 	y.pVersion <- version
 	y.otherPublicKey <- pkey
 	if len(buf) == 0 {
 		buf = nil
 	}
 	if err != nil {
-		y.setErr(err)
+		y.reject(err)
 		return
 	}
 	// Check if node key equal transport key
 	if y.transport_key != nil {
 		if bytes.Compare(y.transport_key, pkey) != 0 {
 			// Invalid transport key
-			y.setErr(static.TransportSecurityCheckError{
+			y.reject(static.TransportSecurityCheckError{
 				Expected: y.transport_key,
 				Received: pkey,
 			})
@@ -204,23 +703,35 @@ func (y *YggConn) middleware() {
 	if y.allowList != nil {
 		if !y.allowList.IsAllow(pkey) {
 			// TODO Write more human readable error text
-			y.setErr(static.IvalidPeerPublicKey{
+			y.reject(static.IvalidPeerPublicKey{
 				Text: "Key received from the peer is not in the allow list",
 			})
 			return
 		}
 	}
+	if err := y.policy.CheckKey(pkey); err != nil {
+		y.reject(err)
+		return
+	}
 	if y.dm != nil {
 		closefunc := y.dm.Check(pkey, y.secureTranport, func() {
-			y.setErr(static.ConnClosedByDeduplicatorError{})
+			y.setErr(static.ConnClosedByDeduplicatorError{Evicted: true})
 		})
 		if closefunc == nil {
-			y.setErr(static.ConnClosedByDeduplicatorError{})
+			y.reject(static.ConnClosedByDeduplicatorError{})
 			return
 		}
-		y.closefn = closefunc
+		y.addCloseHook(closefunc)
+	}
+	event := y.event(nil)
+	y.logger.Log(
+		static.LOG_LEVEL_DEBUG, "Handshake completed",
+		"uri", event.Uri.String(), "remote", event.RemoteAddr,
+		"key", event.PublicKey, "version", event.Version, "security", event.SecurityLevel,
+	)
+	if y.observer != nil {
+		y.observer.OnHandshake(event)
 	}
-	//
 	extraReadBuff = buf
 }
 
@@ -231,7 +742,7 @@ func (y *YggConn) GetVer() (*static.ProtoVersion, error) {
 	v := <-y.pVersion
 	defer func() { y.pVersion <- v }()
 	if v == nil {
-		return nil, y.err
+		return nil, y.getErr()
 	}
 	return v, nil
 }
@@ -243,24 +754,167 @@ func (y *YggConn) GetPublicKey() (ed25519.PublicKey, error) {
 	k := <-y.otherPublicKey
 	defer func() { y.otherPublicKey <- k }()
 	if k == nil {
-		return nil, y.err
+		return nil, y.getErr()
 	}
 	return k, nil
 }
 
+// Returns link priority requested by connected node
+// if handshake pkg was successfully received and parsed.
+// It is always zero for v0.4 protocol.
+func (y *YggConn) GetPriority() (uint8, error) {
+	v := <-y.pVersion
+	defer func() { y.pVersion <- v }()
+	if v == nil {
+		return 0, y.getErr()
+	}
+	return y.priority, nil
+}
+
+// State of YggConn handshake and connection
+type ConnectionState struct {
+	// True if handshake is finished (successfully or not)
+	HandshakeComplete bool
+	// Protocol version (nil until handshake package is received)
+	Version *static.ProtoVersion
+	// Key of connected node (nil until handshake package is received)
+	PeerKey ed25519.PublicKey
+	// Transport lvl key of connected node (may be nil)
+	TransportKey  ed25519.PublicKey
+	SecurityLevel uint
+	// Link priority requested by connected node (always zero for v0.4)
+	Priority uint8
+	// Time spent for handshake (zero until it is finished)
+	HandshakeDuration time.Duration
+	// Error that handshake failed with
+	// or connection was closed with (nil if there is no one)
+	Err error
+}
+
+// Handshake waits until handshake package of connected node
+// is received and validated.
+// It returns nil if connection passed all checks
+// or error that connection was rejected with.
+//
+// Handshake is started automatically on YggConn creation,
+// so calling this method is optional, as in [tls.Conn].
+//
+// If ctx is done before handshake is finished,
+// connection is closed and ctx error is returned.
+func (y *YggConn) Handshake(ctx context.Context) error {
+	select {
+	case <-y.handshakeDone:
+	default:
+		select {
+		case <-y.handshakeDone:
+		case <-ctx.Done():
+			y.setErr(ctx.Err())
+			<-y.handshakeDone
+			return ctx.Err()
+		}
+	}
+	<-y.stateLock
+	defer func() { y.stateLock <- struct{}{} }()
+	return y.handshakeErr
+}
+
+// Returns current state of connection without waiting for handshake.
+func (y *YggConn) ConnectionState() ConnectionState {
+	var priority uint8 = 0
+	complete := false
+	select {
+	case <-y.handshakeDone:
+		complete = true
+		priority = y.priority
+	default:
+	}
+	<-y.stateLock
+	defer func() { y.stateLock <- struct{}{} }()
+	err := y.err
+	if err == nil {
+		err = y.handshakeErr
+	}
+	return ConnectionState{
+		HandshakeComplete: complete,
+		Version:           y.peerVersion,
+		PeerKey:           y.peerKey,
+		TransportKey:      y.transport_key,
+		SecurityLevel:     y.secureTranport,
+		Priority:          priority,
+		HandshakeDuration: y.handshakeDuration,
+		Err:               err,
+	}
+}
+
+// Returns channel that is closed when connection is closed
+// by caller, by DeduplicationManager or because of failed handshake.
+func (y *YggConn) Done() <-chan struct{} {
+	return y.done
+}
+
+// Registers function that will be called once on connection close.
+// If connection is already closed, it is called immediately.
+func (y *YggConn) addCloseHook(hook func()) {
+	closed := <-y.isClosed
+	if !closed {
+		y.closeHooks = append(y.closeHooks, hook)
+	}
+	y.isClosed <- closed
+	if closed {
+		hook()
+	}
+}
+
+// Registers function that will be called once when handshake is finished.
+// If handshake is already finished, it is called immediately.
+func (y *YggConn) addHandshakeHook(hook func()) {
+	<-y.stateLock
+	select {
+	case <-y.handshakeDone:
+		y.stateLock <- struct{}{}
+		hook()
+		return
+	default:
+	}
+	y.handshakeHooks = append(y.handshakeHooks, hook)
+	y.stateLock <- struct{}{}
+}
+
+// Returns peer key and protocol version without waiting for handshake.
+// They are nil if handshake package was not received yet.
+func (y *YggConn) peerInfo() (ed25519.PublicKey, *static.ProtoVersion) {
+	<-y.stateLock
+	defer func() { y.stateLock <- struct{}{} }()
+	return y.peerKey, y.peerVersion
+}
+
 func (y *YggConn) Close() (err error) {
 	closed := <-y.isClosed
-	defer func() { y.isClosed <- closed }()
-	closed = true
-	if y.closefn != nil && !closed {
-		y.closefn()
-		y.closefn = func() {}
+	hooks := y.closeHooks
+	y.closeHooks = nil
+	if !closed {
+		close(y.done)
 	}
-	err = y.innerConn.Close()
-	if y.err != nil {
-		err = y.err
+	// Hooks and observer are called without lock,
+	// so they are free to use the connection
+	y.isClosed <- true
+	if !closed {
+		for _, hook := range hooks {
+			hook()
+		}
+		event := y.event(y.getErr())
+		y.logger.Log(
+			static.LOG_LEVEL_DEBUG, "Connection closed",
+			"uri", event.Uri.String(), "remote", event.RemoteAddr,
+			"key", event.PublicKey, "err", event.Err,
+		)
+		if y.observer != nil {
+			y.observer.OnClose(event)
+		}
 	}
-	return err
+	// Reason of closing is available with ConnectionState,
+	// here the real error of closing is returned.
+	return y.innerConn.Close()
 }
 
 func (y *YggConn) Read(b []byte) (n int, err error) {
@@ -269,6 +923,7 @@ func (y *YggConn) Read(b []byte) (n int, err error) {
 	if buf != nil {
 		err = nil
 		n = copy(b, buf)
+		atomic.AddUint64(&y.bytesRead, uint64(n))
 		if n >= len(buf) {
 			buf = nil
 		} else {
@@ -277,16 +932,19 @@ func (y *YggConn) Read(b []byte) (n int, err error) {
 		return
 	}
 	n, err = y.innerConn.Read(b)
-	if y.err != nil {
-		err = y.err
+	atomic.AddUint64(&y.bytesRead, uint64(n))
+	if yerr := y.getErr(); yerr != nil {
+		err = yerr
 	}
 	return
 }
 
 func (y *YggConn) Write(b []byte) (n int, err error) {
+	<-y.handshakeSent
 	n, err = y.innerConn.Write(b)
-	if y.err != nil {
-		err = y.err
+	atomic.AddUint64(&y.bytesWritten, uint64(n))
+	if yerr := y.getErr(); yerr != nil {
+		err = yerr
 	}
 	return
 }
@@ -300,50 +958,171 @@ func (y *YggConn) RemoteAddr() net.Addr {
 }
 
 func (y *YggConn) SetDeadline(t time.Time) (err error) {
-	err = y.innerConn.SetDeadline(t)
-	if y.err != nil {
-		err = y.err
+	<-y.stateLock
+	y.readDeadline = t
+	if y.handshakeRead {
+		err = y.innerConn.SetDeadline(t)
+	} else {
+		err = y.innerConn.SetWriteDeadline(t)
+	}
+	y.stateLock <- struct{}{}
+	if yerr := y.getErr(); yerr != nil {
+		err = yerr
 	}
 	return
 }
 
 func (y *YggConn) SetReadDeadline(t time.Time) (err error) {
-	err = y.innerConn.SetReadDeadline(t)
-	if y.err != nil {
-		err = y.err
+	<-y.stateLock
+	y.readDeadline = t
+	if y.handshakeRead {
+		err = y.innerConn.SetReadDeadline(t)
+	}
+	y.stateLock <- struct{}{}
+	if yerr := y.getErr(); yerr != nil {
+		err = yerr
 	}
 	return
 }
 
 func (y *YggConn) SetWriteDeadline(t time.Time) (err error) {
 	err = y.innerConn.SetWriteDeadline(t)
-	if y.err != nil {
-		err = y.err
+	if yerr := y.getErr(); yerr != nil {
+		err = yerr
 	}
 	return
 }
 
 // Allows accepting incoming connections
 type YggListener struct {
-	inner_listener static.TransportListener
-	dm             *DeduplicationManager
-	allowList      *static.AllowList
+	inner_listener   static.TransportListener
+	observer         ConnObserver
+	logger           static.Logger
+	dm               *DeduplicationManager
+	allowList        func() static.KeyFilter
+	key              ed25519.PrivateKey
+	handshakeVersion *static.ProtoVersion
+	password         []byte
+	uri              url.URL
+	registry         *ConnRegistry
+	onClose          func()
+	handshakeTimeout time.Duration
+	policy           *static.Policy
 }
 
 // Accept waits for and returns the next connection to the listener.
-func (y *YggListener) Accept() (ygg YggConn, err error) {
-	conn, err := y.inner_listener.AcceptConn()
+//
+// Returned connection may be closed later
+// if it does not pass handshake checks.
+// Use ValidatingListener to get only validated connections.
+//
+// Connections which remote address or transport key
+// is denied by policy are closed before handshake
+// and are not returned.
+func (y *YggListener) Accept() (ygg *YggConn, err error) {
+	for {
+		conn, err := y.inner_listener.AcceptConn()
+		if err != nil {
+			return nil, err
+		}
+		if err := y.checkPolicy(conn); err != nil {
+			y.reject(conn, err)
+			continue
+		}
+		return y.wrap(conn, y.handshakeTimeout, nil)
+	}
+}
+
+// Checks remote address and transport key of accepted connection
+// before any handshake bytes are read.
+func (y *YggListener) checkPolicy(conn static.ConnResult) error {
+	if err := y.policy.CheckIp(static.IpFromAddr(conn.Conn.RemoteAddr())); err != nil {
+		return err
+	}
+	if conn.Pkey != nil {
+		return y.policy.CheckKey(conn.Pkey)
+	}
+	return nil
+}
+
+// Notifies observer and logger about connection
+// rejected before handshake and closes it.
+func (y *YggListener) reject(conn static.ConnResult, err error) {
+	event := ConnEvent{
+		Uri:           *static.RedactUri(y.uri),
+		RemoteAddr:    conn.Conn.RemoteAddr(),
+		PublicKey:     conn.Pkey,
+		SecurityLevel: conn.SecurityLevel,
+		Direction:     DIRECTION_INBOUND,
+		Err:           err,
+	}
+	if y.logger != nil {
+		y.logger.Log(
+			static.LOG_LEVEL_INFO, "Connection rejected",
+			"uri", event.Uri.String(), "remote", event.RemoteAddr, "reason", err,
+		)
+	}
+	if y.observer != nil {
+		y.observer.OnReject(event, err)
+	}
+	conn.Conn.Close()
+}
+
+// Wraps accepted transport connection to YggConn
+// with passed handshake timeout and registers it in ConnManager.
+func (y *YggListener) wrap(conn static.ConnResult, handshakeTimeout time.Duration, handshakeSlots chan struct{}) (ygg *YggConn, err error) {
+	if y.observer != nil {
+		y.observer.OnAccept(ConnEvent{
+			Uri:           *static.RedactUri(y.uri),
+			RemoteAddr:    conn.Conn.RemoteAddr(),
+			PublicKey:     conn.Pkey,
+			SecurityLevel: conn.SecurityLevel,
+			Direction:     DIRECTION_INBOUND,
+		})
+	}
+	var allowList static.KeyFilter = nil
+	if y.allowList != nil {
+		allowList = y.allowList()
+	}
+	if y.registry != nil {
+		if !y.registry.Reserve() {
+			conn.Conn.Close()
+			return nil, static.ManagerClosedError{}
+		}
+		defer y.registry.Release()
+	}
+	ygg, err = ConnToYggConnWithOptions(
+		conn.Conn, conn.Pkey, nil, conn.SecurityLevel, y.dm,
+		YggConnOptions{
+			Key:              y.key,
+			HandshakeVersion: y.handshakeVersion,
+			Password:         y.password,
+			Observer:         y.observer,
+			Uri:              y.uri,
+			Direction:        DIRECTION_INBOUND,
+			Logger:           y.logger,
+			HandshakeTimeout: handshakeTimeout,
+			Policy:           y.policy,
+			AllowKeys:        allowList,
+			handshakeSlots:   handshakeSlots,
+		},
+	)
 	if err != nil {
 		return
 	}
-	yggr := ConnToYggConn(conn.Conn, conn.Pkey, y.allowList, conn.SecurityLevel, y.dm)
-	ygg = *yggr
+	if y.registry != nil && !y.registry.Add(ygg, y.uri, DIRECTION_INBOUND) {
+		ygg = nil
+		err = static.ManagerClosedError{}
+	}
 	return
 }
 
 // Close closes the listener.
 // Any blocked Accept operations will be unblocked and return errors.
 func (y *YggListener) Close() error {
+	if y.onClose != nil {
+		y.onClose()
+	}
 	return y.inner_listener.Close()
 }
 
@@ -20,12 +20,14 @@ package ytl
 
 import (
 	"bytes"
+	"context"
 	"crypto/ed25519"
 	"encoding/hex"
 	"github.com/DomesticMoth/ytl/debugstuff"
 	"github.com/DomesticMoth/ytl/static"
 	"io"
 	"net"
+	"runtime"
 	"testing"
 	"time"
 )
@@ -71,7 +73,7 @@ func TestParceMetaPackage(t *testing.T) {
 		},
 	}
 	for _, cse := range cases {
-		err, version, pkey, buf := parseMetaPackage(cse.conn, time.Minute/2)
+		err, version, pkey, _, buf := parseMetaPackage(cse.conn, time.Minute/2, nil)
 		if err != cse.err {
 			t.Fatalf("Wrong err %s %s", err, cse.err)
 		}
@@ -239,3 +241,451 @@ func TestYggConnNoCollisionSI(t *testing.T) {
 func TestYggConnNoCollisionSS(t *testing.T) {
 	yggConnTestCollision(t, 1, 0, 0)
 }
+
+func TestParceV5MetaPackage(t *testing.T) {
+	v := static.PROTO_VERSION_0_5()
+	v2 := static.ProtoVersion{Major: 0, Minor: 6}
+	size := debugstuff.MockV5MetaPackageSize
+	cases := []CaseTestParceMetaPackage{
+		{
+			debugstuff.MockV5Conn(),
+			nil,
+			&v,
+			debugstuff.MockV5PubKey(),
+			debugstuff.MockConnV5Content()[:size],
+		},
+		{
+			debugstuff.MockV5WrongSignatureConn(),
+			static.InvalidSignatureError{},
+			&v,
+			nil,
+			debugstuff.MockConnV5WrongSignatureContent()[:size],
+		},
+		{
+			debugstuff.MockV5WrongVerConn(),
+			static.UnknownProtoVersionError{
+				Expected: static.PROTO_VERSION_0_5(),
+				Received: v2,
+			},
+			&v2,
+			nil,
+			debugstuff.MockConnV5WrongVerContent()[:size],
+		},
+	}
+	for _, cse := range cases {
+		err, version, pkey, _, buf := parseMetaPackage(cse.conn, time.Minute/2, nil)
+		if err != cse.err {
+			t.Fatalf("Wrong err %s %s", err, cse.err)
+		}
+		if version == nil || version.Major != cse.version.Major || version.Minor != cse.version.Minor {
+			t.Fatalf("Wrong version %s %s", version, cse.version)
+		}
+		if bytes.Compare(pkey, cse.pkey) != 0 {
+			t.Fatalf(
+				"Wrong PublicKey %s %s",
+				hex.EncodeToString(pkey),
+				hex.EncodeToString(cse.pkey),
+			)
+		}
+		if bytes.Compare(buf, cse.buf) != 0 {
+			t.Fatalf(
+				"Wrong buf %s %s",
+				hex.EncodeToString(buf),
+				hex.EncodeToString(cse.buf),
+			)
+		}
+	}
+}
+
+func TestYggConnV5CorrectReading(t *testing.T) {
+	data := debugstuff.MockConnV5Content()
+	yggcon := ConnToYggConn(
+		debugstuff.MockV5Conn(),
+		debugstuff.MockV5PubKey(),
+		nil,
+		0,
+		nil,
+	)
+	defer yggcon.Close()
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(yggcon, buf); err != nil {
+		t.Fatalf("Error while reading from yggcon '%s'", err)
+	}
+	if bytes.Compare(data, buf) != 0 {
+		t.Errorf("Readed data is not eq to writed data")
+	}
+	version, err := yggcon.GetVer()
+	if err != nil {
+		t.Errorf("Error while reading version %s", err)
+	} else if *version != static.PROTO_VERSION_0_5() {
+		t.Errorf("Invalid version %s", version)
+	}
+	key, err := yggcon.GetPublicKey()
+	if err != nil {
+		t.Errorf("Error while reading public key %s", err)
+	} else if bytes.Compare(key, debugstuff.MockV5PubKey()) != 0 {
+		t.Errorf("Invalid key")
+	}
+	priority, err := yggcon.GetPriority()
+	if err != nil {
+		t.Errorf("Error while reading priority %s", err)
+	} else if priority != 1 {
+		t.Errorf("Invalid priority %d", priority)
+	}
+}
+
+func TestYggConnSendHandshake(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	for _, target_version := range static.SUPPORTED_PROTO_VERSIONS() {
+		a, b := net.Pipe()
+		yggcon, err := ConnToYggConnWithHandshake(a, nil, nil, 0, nil, priv, target_version)
+		if err != nil {
+			t.Fatalf("Error while wrapping conn %s", err)
+		}
+		go b.Write(debugstuff.MockConnContent())
+		err, version, key, _, _ := internalParseMetaPackage(b, nil)
+		if err != nil {
+			t.Fatalf("Error while parsing sent handshake %s", err)
+		}
+		if *version != target_version {
+			t.Errorf("Invalid version %s %s", version, target_version)
+		}
+		if bytes.Compare(key, pub) != 0 {
+			t.Errorf("Invalid key")
+		}
+		data := []byte("data")
+		go yggcon.Write(data)
+		buf := make([]byte, len(data))
+		if _, err := io.ReadFull(b, buf); err != nil {
+			t.Fatalf("Error while reading written data %s", err)
+		}
+		if bytes.Compare(data, buf) != 0 {
+			t.Errorf("Readed data is not eq to writed data")
+		}
+		yggcon.Close()
+		b.Close()
+	}
+}
+
+func TestYggConnSendHandshakeUnknownVersion(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	_, err := ConnToYggConnWithHandshake(a, nil, nil, 0, nil, nil, static.ProtoVersion{Major: 1, Minor: 0})
+	if err == nil {
+		t.Fatalf("Unknown handshake version should cause an error")
+	}
+}
+
+func TestParceMetaPackagePassword(t *testing.T) {
+	password := debugstuff.MockPassword()
+	type Case struct {
+		conn     net.Conn
+		password []byte
+		err      error
+	}
+	cases := []Case{
+		{debugstuff.MockV5PasswordConn(), password, nil},
+		{debugstuff.MockV5PasswordConn(), []byte("wrong"), static.InvalidPasswordError{}},
+		{debugstuff.MockV5PasswordConn(), nil, static.InvalidSignatureError{}},
+		{debugstuff.MockV5Conn(), password, static.InvalidPasswordError{}},
+		{debugstuff.MockConn(), password, static.InvalidPasswordError{}},
+	}
+	for i, cse := range cases {
+		err, _, pkey, _, _ := parseMetaPackage(cse.conn, time.Minute/2, cse.password)
+		if err != cse.err {
+			t.Errorf("Wrong err in case %d: %s %s", i, err, cse.err)
+		}
+		if err == nil && bytes.Compare(pkey, debugstuff.MockV5PubKey()) != 0 {
+			t.Errorf("Wrong PublicKey in case %d", i)
+		}
+		cse.conn.Close()
+	}
+}
+
+func TestYggConnPasswordHandshake(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	password := debugstuff.MockPassword()
+	a, b := net.Pipe()
+	defer b.Close()
+	version := static.PROTO_VERSION_0_5()
+	yggcon, err := ConnToYggConnWithOptions(a, nil, nil, 0, nil, YggConnOptions{
+		Key:              priv,
+		HandshakeVersion: &version,
+		Password:         password,
+	})
+	if err != nil {
+		t.Fatalf("Error while wrapping conn %s", err)
+	}
+	defer yggcon.Close()
+	go b.Write(debugstuff.MockConnV5PasswordContent())
+	if err, _, _, _, _ := internalParseMetaPackage(b, password); err != nil {
+		t.Fatalf("Error while parsing sent handshake %s", err)
+	}
+	if _, err := yggcon.GetPublicKey(); err != nil {
+		t.Errorf("Error while reading public key %s", err)
+	}
+}
+
+func TestParceMetaPackageDeadline(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	go b.Write(debugstuff.MockConnContent()[:10])
+	started := time.Now()
+	err, version, pkey, _, buf := parseMetaPackage(a, time.Millisecond*50, nil)
+	if err != (static.ConnTimeoutError{}) {
+		t.Fatalf("Wrong err %s", err)
+	}
+	if version != nil || pkey != nil || buf != nil {
+		t.Errorf("Partial package must not be returned")
+	}
+	if time.Since(started) > time.Second*5 {
+		t.Errorf("Timeout is too long")
+	}
+	if _, err := a.Write([]byte{0}); err == nil {
+		t.Errorf("Connection was not closed after timeout")
+	}
+}
+
+func TestParceMetaPackageTooLong(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	// Peer declares maximal length but sends nothing after it
+	go b.Write(append(static.META_HEADER(), 0, 0xff))
+	err, _, _, _, buf := parseMetaPackage(a, time.Second*5, nil)
+	switch err.(type) {
+	case static.InvalidMetaPackageError:
+		// Ok
+	default:
+		t.Fatalf("Wrong err %s", err)
+	}
+	if buf != nil {
+		t.Errorf("Buffer was allocated for too long package")
+	}
+}
+
+func TestYggConnRestoresReadDeadline(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	yggcon := ConnToYggConn(local, nil, nil, 0, nil)
+	defer yggcon.Close()
+	if err := yggcon.SetReadDeadline(time.Now().Add(time.Millisecond * 200)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	header := debugstuff.MockConnContent()[:6+ed25519.PublicKeySize]
+	go remote.Write(header)
+	// Unblocks reading if deadline was lost
+	timer := time.AfterFunc(time.Second*2, func() { remote.Close() })
+	defer timer.Stop()
+	started := time.Now()
+	// Handshake package is passed to reader as is
+	if _, err := io.ReadFull(yggcon, make([]byte, len(header))); err != nil {
+		t.Fatalf("Error while reading handshake package: %s", err)
+	}
+	if _, err := yggcon.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("Read must fail by deadline")
+	}
+	if time.Since(started) > time.Second {
+		t.Errorf("Read deadline was cleared by handshake")
+	}
+}
+
+func TestYggConnDeadlineKeepsHandshakeTimeout(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	yggcon, _ := ConnToYggConnWithOptions(local, nil, nil, 0, nil, YggConnOptions{
+		HandshakeTimeout: time.Millisecond * 100,
+	})
+	defer yggcon.Close()
+	// Deadlines set by user while handshake package is read
+	// must not turn off handshake timeout
+	time.Sleep(time.Millisecond * 20)
+	yggcon.SetDeadline(time.Time{})
+	yggcon.SetReadDeadline(time.Now().Add(time.Hour))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	if err := yggcon.Handshake(ctx); err != (static.ConnTimeoutError{}) {
+		t.Errorf("Wrong handshake error: %v", err)
+	}
+}
+
+// In-memory connection that supports only reading
+type benchConn struct {
+	net.Conn
+	reader *bytes.Reader
+}
+
+func (c *benchConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *benchConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *benchConn) Close() error {
+	return nil
+}
+
+type parseFunc func(net.Conn, time.Duration, []byte) (
+	error, *static.ProtoVersion, ed25519.PublicKey, uint8, []byte,
+)
+
+// Baseline implementation of parseMetaPackage
+// that waits for package in extra goroutine with time.After.
+// It is used only for comparison in benchmarks.
+func parseMetaPackageWithTimer(conn net.Conn, timeout time.Duration, password []byte) (
+	err error,
+	version *static.ProtoVersion,
+	pkey ed25519.PublicKey,
+	priority uint8,
+	buf []byte,
+) {
+	type result struct {
+		err      error
+		version  *static.ProtoVersion
+		pkey     ed25519.PublicKey
+		priority uint8
+		buf      []byte
+	}
+	ret := make(chan result, 1)
+	go func() {
+		err, version, pkey, priority, buf := internalParseMetaPackage(conn, password)
+		ret <- result{err, version, pkey, priority, buf}
+	}()
+	select {
+	case <-time.After(timeout):
+		conn.Close()
+		err = static.ConnTimeoutError{}
+		return
+	case ret := <-ret:
+		return ret.err, ret.version, ret.pkey, ret.priority, ret.buf
+	}
+}
+
+func benchmarkParseMetaPackage(b *testing.B, parse parseFunc, content []byte) {
+	conn := &benchConn{reader: bytes.NewReader(content)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn.reader.Reset(content)
+		if err, _, _, _, _ := parse(conn, time.Minute, nil); err != nil {
+			b.Fatalf("Unexpected error: %s", err)
+		}
+	}
+}
+
+func BenchmarkParseMetaPackage(b *testing.B) {
+	benchmarkParseMetaPackage(b, parseMetaPackage, debugstuff.MockConnContent())
+}
+
+func BenchmarkParseV5MetaPackage(b *testing.B) {
+	benchmarkParseMetaPackage(b, parseMetaPackage, debugstuff.MockConnV5Content())
+}
+
+func BenchmarkParseMetaPackageWithTimer(b *testing.B) {
+	benchmarkParseMetaPackage(b, parseMetaPackageWithTimer, debugstuff.MockConnContent())
+}
+
+func BenchmarkParseV5MetaPackageWithTimer(b *testing.B) {
+	benchmarkParseMetaPackage(b, parseMetaPackageWithTimer, debugstuff.MockConnV5Content())
+}
+
+// Measures memory held by connections
+// that never send handshake package.
+func BenchmarkPendingHandshakes(b *testing.B) {
+	conns := make([]*YggConn, 0, b.N)
+	remotes := make([]net.Conn, 0, b.N)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		local, remote := net.Pipe()
+		conns = append(conns, ConnToYggConn(local, nil, nil, 0, nil))
+		remotes = append(remotes, remote)
+	}
+	// Let all middlewares block on reading
+	time.Sleep(time.Millisecond * 100)
+	b.StopTimer()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	used := (after.HeapInuse + after.StackInuse) - (before.HeapInuse + before.StackInuse)
+	b.ReportMetric(float64(used)/float64(b.N), "bytes/conn")
+	for i, conn := range conns {
+		conn.Close()
+		remotes[i].Close()
+	}
+}
+
+func TestYggConnHandshake(t *testing.T) {
+	yggcon := ConnToYggConn(debugstuff.MockConn(), debugstuff.MockPubKey(), nil, 1, nil)
+	defer yggcon.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := yggcon.Handshake(ctx); err != nil {
+		t.Fatalf("Unexpected handshake error: %s", err)
+	}
+	state := yggcon.ConnectionState()
+	if !state.HandshakeComplete {
+		t.Errorf("Handshake is not marked as complete")
+	}
+	if state.Version == nil || *state.Version != static.PROTO_VERSION() {
+		t.Errorf("Wrong version %s", state.Version)
+	}
+	if bytes.Compare(state.PeerKey, debugstuff.MockPubKey()) != 0 {
+		t.Errorf("Wrong peer key")
+	}
+	if bytes.Compare(state.TransportKey, debugstuff.MockPubKey()) != 0 {
+		t.Errorf("Wrong transport key")
+	}
+	if state.SecurityLevel != 1 || state.Err != nil || state.HandshakeDuration <= 0 {
+		t.Errorf("Wrong state %v", state)
+	}
+	// Finished handshake is reported even with done ctx
+	cancel()
+	for i := 0; i < 100; i++ {
+		if err := yggcon.Handshake(ctx); err != nil {
+			t.Fatalf("Finished handshake returned ctx error: %s", err)
+		}
+	}
+}
+
+func TestYggConnHandshakeError(t *testing.T) {
+	yggcon := ConnToYggConn(debugstuff.MockConn(), make([]byte, 32), nil, 0, nil)
+	defer yggcon.Close()
+	err := yggcon.Handshake(context.Background())
+	switch err.(type) {
+	case static.TransportSecurityCheckError:
+		// Ok
+	default:
+		t.Fatalf("Wrong handshake error: %s", err)
+	}
+	state := yggcon.ConnectionState()
+	if !state.HandshakeComplete || state.Err == nil || state.Err.Error() != err.Error() {
+		t.Errorf("Wrong state %v", state)
+	}
+}
+
+func TestYggConnHandshakeCancel(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	yggcon := ConnToYggConn(a, nil, nil, 0, nil)
+	defer yggcon.Close()
+	if state := yggcon.ConnectionState(); state.HandshakeComplete || state.PeerKey != nil {
+		t.Errorf("Handshake is complete before package is received")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := yggcon.Handshake(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Wrong handshake error: %s", err)
+	}
+	select {
+	case <-yggcon.Done():
+	default:
+		t.Errorf("Connection was not closed after handshake cancelation")
+	}
+	if state := yggcon.ConnectionState(); state.Err != context.DeadlineExceeded {
+		t.Errorf("Wrong terminal error %s", state.Err)
+	}
+}